@@ -0,0 +1,31 @@
+package lineserver
+
+import (
+    "crypto/subtle"
+    "net"
+)
+
+const (
+    ShutdownOff      = "off"       // No client may shut down the server
+    ShutdownLoopback = "loopback"  // Only clients connected over the loopback interface
+    ShutdownToken    = "token"     // Only clients presenting the admin token
+    ShutdownAdmin    = "admin"     // Only clients connected to the admin listener
+)
+
+//
+// Function: authorize_admin
+//
+// Purpose: Decides, per the shutdown policy, whether a client may use an administrative command
+//
+func authorize_admin(opts *Options, client net.Conn, admin bool, token string) bool {
+    switch opts.ShutdownPolicy {
+    case ShutdownLoopback:
+        addr, ok := client.RemoteAddr().(*net.TCPAddr)
+        return ok && addr.IP.IsLoopback()
+    case ShutdownToken:
+        return opts.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(opts.AdminToken)) == 1
+    case ShutdownAdmin:
+        return admin
+    }
+    return false
+}
@@ -0,0 +1,145 @@
+package lineserver
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "io"
+    "log"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+//
+// Function: dial_client
+//
+// Purpose: Connects to addr, and returns a function that sends requests on the connection and
+//          checks the lines that come back. The connection stays open between requests.
+//
+func dial_client(t *testing.T, addr string) func(requests string, want ...string) {
+    t.Helper()
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+    reader := bufio.NewReader(conn)
+
+    return func(requests string, want ...string) {
+        t.Helper()
+        io.WriteString(conn, requests)
+        for _, w := range want {
+            if line, err := reader.ReadString('\n'); err != nil || line != w {
+                t.Fatalf("%q: got %q %v, want %q", requests, line, err, w)
+            }
+        }
+        if len(want) == 0 {
+            if line, err := reader.ReadString('\n'); err != io.EOF {
+                t.Fatalf("%q: got %q %v, want EOF", requests, line, err)
+            }
+        }
+    }
+}
+
+//
+// Function: expect_shutdown
+//
+// Purpose: Checks whether the server has begun to shut down, waiting a little for it to begin
+//
+func expect_shutdown(t *testing.T, srv *Server, want bool) {
+    t.Helper()
+    select {
+    case <-srv.ShuttingDown():
+        if !want {
+            t.Fatal("server shutting down after a denied SHUTDOWN")
+        }
+    case <-time.After(100 * time.Millisecond):
+        if want {
+            t.Fatal("server not shutting down after an authorized SHUTDOWN")
+        }
+    }
+}
+
+func TestShutdownToken(t *testing.T) {
+    srv, addr, served := start_test_server(t, "a\n", Options{ShutdownPolicy: ShutdownToken, AdminToken: "secret"})
+
+    // A missing or wrong token is denied, and the client stays connected
+    expect := dial_client(t, addr)
+    expect("SHUTDOWN\r\n", "DENIED\r\n")
+    expect("SHUTDOWN wrong\r\n", "DENIED\r\n")
+    expect("SHUTDOWN secret2\r\n", "DENIED\r\n")
+    expect("GET 1\r\n", "OK\r\n", "a\r\n")
+    expect_shutdown(t, srv, false)
+
+    // The right token shuts the server down, and disconnects the client
+    expect("SHUTDOWN secret\r\n")
+    expect_shutdown(t, srv, true)
+    if err := <-served; err != ErrServerClosed {
+        t.Errorf("Serve returned %v, want %v", err, ErrServerClosed)
+    }
+}
+
+func TestShutdownAdmin(t *testing.T) {
+    srv, addr, served := start_test_server(t, "a\n", Options{ShutdownPolicy: ShutdownAdmin, MaxClients: 1, AdmitPolicy: AdmitReject})
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go srv.ServeAdmin(l)
+
+    // A client of the main listener is denied, and holds the only client slot
+    expect := dial_client(t, addr)
+    expect("SHUTDOWN\r\n", "DENIED\r\n")
+    expect("GET 1\r\n", "OK\r\n", "a\r\n")
+    expect_shutdown(t, srv, false)
+
+    // Admin connections need no slot
+    expect_admin := dial_client(t, l.Addr().String())
+    expect_admin2 := dial_client(t, l.Addr().String())
+    expect_admin("COUNT\r\n", "OK\r\n", "1\r\n")
+    expect_admin2("COUNT\r\n", "OK\r\n", "1\r\n")
+    if active, _, _ := srv.Clients(); active != 3 {
+        t.Errorf("%d clients active, want 3", active)
+    }
+    if reply := exchange(t, addr, ""); string(reply) != "BUSY\r\n" {
+        t.Errorf("client of the main listener: got %q, want %q", reply, "BUSY\r\n")
+    }
+
+    // An admin connection may shut the server down
+    expect_admin("SHUTDOWN\r\n")
+    expect_shutdown(t, srv, true)
+    if err := <-served; err != ErrServerClosed {
+        t.Errorf("Serve returned %v, want %v", err, ErrServerClosed)
+    }
+}
+
+func TestAdminTokenNotLogged(t *testing.T) {
+    var messages bytes.Buffer
+    srv, addr, _ := start_test_server(t, "a\n", Options{ShutdownPolicy: ShutdownToken, AdminToken: "s3cret",
+        Logger: log.New(&messages, "", 0)})
+
+    expect := dial_client(t, addr)
+    expect("RELOAD wr0ng\r\n", "DENIED\r\n")
+    expect("SHUTDOWN wr0ng\r\n", "DENIED\r\n")
+    expect("RELOAD s3cret\r\n", "OK\r\n")
+    expect("SHUTDOWN s3cret\r\n")
+
+    // Once the server has stopped, nothing more is logged
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    if err := srv.Shutdown(ctx); err != nil {
+        t.Fatal(err)
+    }
+    logged := messages.String()
+    if !strings.Contains(logged, "Command: RELOAD\n") || !strings.Contains(logged, "Command: SHUTDOWN\n") {
+        t.Errorf("logged %q, want the commands", logged)
+    }
+    for _, token := range []string{"s3cret", "wr0ng"} {
+        if strings.Contains(logged, token) {
+            t.Errorf("token %q logged: %q", token, logged)
+        }
+    }
+}
@@ -0,0 +1,131 @@
+package lineserver
+
+import (
+    "net"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    AdmitQueue  = "queue"
+    AdmitReject = "reject"
+)
+
+//
+//  admission object and methods - enforces the maximum number of concurrent clients, and keeps
+//  the current, peak and total client counts
+//
+type admission struct {
+    active        uint64            // Updated atomically
+    peak          uint64            // Updated atomically
+    total         uint64            // Clients admitted since startup; updated atomically
+    slots         chan struct{}     // One token per admitted client; nil when unlimited
+    policy        string
+    queue_timeout time.Duration     // Zero means wait indefinitely
+}
+
+func new_admission(max_clients int, policy string, queue_timeout time.Duration) *admission {
+    a := &admission{policy: policy, queue_timeout: queue_timeout}
+    if max_clients > 0 {
+        a.slots = make(chan struct{}, max_clients)
+    }
+    return a
+}
+
+func (a *admission) Active() uint64 {
+    return atomic.LoadUint64(&a.active)
+}
+
+func (a *admission) Peak() uint64 {
+    return atomic.LoadUint64(&a.peak)
+}
+
+func (a *admission) Total() uint64 {
+    return atomic.LoadUint64(&a.total)
+}
+
+//
+// Method: Admit
+//
+// Purpose: Claims a client slot according to the admission policy. Returns false if the client
+//          must be turned away. Exempt clients (admin connections) are counted, but need no slot.
+//
+func (a *admission) Admit(state *serverState, exempt bool) bool {
+    if a.slots != nil && !exempt {
+        if !a.acquire(state) {
+            return false
+        }
+    }
+
+    active := atomic.AddUint64(&a.active, 1)
+    for {
+        peak := atomic.LoadUint64(&a.peak)
+        if active <= peak || atomic.CompareAndSwapUint64(&a.peak, peak, active) {
+            break
+        }
+    }
+    atomic.AddUint64(&a.total, 1)
+    return true
+}
+
+func (a *admission) acquire(state *serverState) bool {
+    // Fast path: a slot is free
+    select {
+    case a.slots <- struct{}{}:
+        return true
+    default:
+    }
+    if a.policy == AdmitReject {
+        return false
+    }
+
+    var expired <-chan time.Time
+    if a.queue_timeout > 0 {
+        timer := time.NewTimer(a.queue_timeout)
+        defer timer.Stop()
+        expired = timer.C
+    }
+
+    // Queue until a slot frees, the queue wait expires, or the server shuts down
+    select {
+    case a.slots <- struct{}{}:
+        return true
+    case <-expired:
+        return false
+    case <-state.ShuttingDown():
+        return false
+    }
+}
+
+//
+// Method: Release
+//
+// Purpose: Frees the slot of a departing client
+//
+func (a *admission) Release(exempt bool) {
+    atomic.AddUint64(&a.active, ^uint64(0))
+    if a.slots != nil && !exempt {
+        <-a.slots
+    }
+}
+
+//
+// GoRoutine: admit_client
+//
+// Purpose: Admits a new client connection and runs its protocol's client handler, or turns it away
+//          with the protocol's BUSY response
+//
+func admit_client(client net.Conn, state *serverState, admin bool, proto *protocol) {
+    if !state.clients.Admit(state, admin) {
+        state.opts.Logger.Printf("Turning away %s: server busy\n", client.RemoteAddr().String())
+        client.SetWriteDeadline(time.Now().Add(time.Second))
+        client.Write(proto.busy)
+        client.Close()
+        state.Done()
+        return
+    }
+
+    state.opts.Logger.Printf("Admitted %s: %d active clients, peak %d, %d total\n", client.RemoteAddr().String(),
+        state.clients.Active(), state.clients.Peak(), state.clients.Total())
+    proto.handler(client, state.opts.IdleTimeout, state, admin)
+}
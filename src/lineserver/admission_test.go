@@ -0,0 +1,115 @@
+package lineserver
+
+import (
+    "bufio"
+    "io/ioutil"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestAdmissionQueue(t *testing.T) {
+    state := new_server_state(test_options(t, Options{}), nil)
+    a := new_admission(1, AdmitQueue, 100 * time.Millisecond)
+
+    if !a.Admit(state, false) {
+        t.Fatal("first client turned away")
+    }
+
+    // An admin connection needs no slot, but is counted
+    if !a.Admit(state, true) {
+        t.Fatal("exempt client turned away")
+    }
+    a.Release(true)
+
+    // Queued until the slot frees
+    go func() {
+        time.Sleep(20 * time.Millisecond)
+        a.Release(false)
+    }()
+    start := time.Now()
+    if !a.Admit(state, false) {
+        t.Fatal("queued client turned away")
+    }
+    if waited := time.Since(start); waited < 20 * time.Millisecond {
+        t.Errorf("queued client admitted after %s, before the slot was freed", waited)
+    }
+
+    // Turned away once the queue wait expires
+    start = time.Now()
+    if a.Admit(state, false) {
+        t.Fatal("client admitted with no free slot")
+    }
+    if waited := time.Since(start); waited < 100 * time.Millisecond {
+        t.Errorf("queued client turned away after %s, want the queue timeout", waited)
+    }
+
+    if active, peak, total := a.Active(), a.Peak(), a.Total(); active != 1 || peak != 2 || total != 3 {
+        t.Errorf("active %d, peak %d, total %d; want 1, 2, 3", active, peak, total)
+    }
+}
+
+func TestAdmissionQueueShutdown(t *testing.T) {
+    state := new_server_state(test_options(t, Options{}), nil)
+    a := new_admission(1, AdmitQueue, 0)
+    a.Admit(state, false)
+
+    // A queue wait without a timeout still ends at shutdown
+    go func() {
+        time.Sleep(20 * time.Millisecond)
+        state.InitiateShutdown()
+    }()
+    if a.Admit(state, false) {
+        t.Fatal("client admitted with no free slot")
+    }
+}
+
+func TestAdmissionReject(t *testing.T) {
+    state := new_server_state(test_options(t, Options{}), nil)
+    a := new_admission(1, AdmitReject, time.Hour)
+
+    if !a.Admit(state, false) {
+        t.Fatal("first client turned away")
+    }
+    start := time.Now()
+    if a.Admit(state, false) {
+        t.Fatal("client admitted with no free slot")
+    }
+    if waited := time.Since(start); waited > time.Second {
+        t.Errorf("rejected after %s, want at once", waited)
+    }
+    a.Release(false)
+    if !a.Admit(state, false) {
+        t.Fatal("client turned away from a free slot")
+    }
+}
+
+func TestAdmissionBusy(t *testing.T) {
+    srv, addr, _ := start_test_server(t, "a\n", Options{MaxClients: 1, AdmitPolicy: AdmitReject})
+
+    // One client holds the only slot
+    held, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer held.Close()
+    held.Write([]byte("GET 1\r\n"))
+    if reply, err := bufio.NewReader(held).ReadString('\n'); err != nil || reply != "OK\r\n" {
+        t.Fatalf("held client: %q %v", reply, err)
+    }
+
+    // The next is told so, and disconnected
+    busy, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer busy.Close()
+    busy.SetDeadline(time.Now().Add(10 * time.Second))
+    if reply, err := ioutil.ReadAll(busy); err != nil || string(reply) != "BUSY\r\n" {
+        t.Errorf("turned away client: %q %v, want %q", reply, err, "BUSY\r\n")
+    }
+
+    if active, peak, total := srv.Clients(); active != 1 || peak != 1 || total != 1 {
+        t.Errorf("active %d, peak %d, total %d; want 1, 1, 1", active, peak, total)
+    }
+}
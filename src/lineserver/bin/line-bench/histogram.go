@@ -0,0 +1,172 @@
+package main
+
+import (
+    "math"
+    "math/bits"
+    "time"
+)
+
+//
+//  Latency histogram. Values are counted in log-linear buckets: each power of two nanoseconds is
+//  split into 2^hist_sub_bits buckets, so a reported percentile is within ~3% of the true value,
+//  whatever the range of latencies, and histograms of any number of requests have the same size.
+//
+const (
+    hist_sub_bits    = 5
+    hist_sub_buckets = 1 << hist_sub_bits
+    hist_buckets     = 64 * hist_sub_buckets
+)
+
+//
+//  Histogram object and methods - the latencies of one worker's requests, or of a whole run
+//
+type Histogram struct {
+    counts [hist_buckets]uint64
+    total  uint64
+    sum    time.Duration
+    min    time.Duration
+    max    time.Duration
+}
+
+//
+// Function: bucket_of
+//
+// Purpose: Returns the index of the bucket counting a latency of ns nanoseconds
+//
+func bucket_of(ns uint64) int {
+    if ns < hist_sub_buckets {
+        return int(ns)
+    }
+    shift := uint(bits.Len64(ns) - 1 - hist_sub_bits)
+    return int(shift + 1) << hist_sub_bits + int(ns >> shift) - hist_sub_buckets
+}
+
+//
+// Function: bucket_limit
+//
+// Purpose: Returns the highest latency, in nanoseconds, counted by bucket i
+//
+func bucket_limit(i int) uint64 {
+    if i < hist_sub_buckets {
+        return uint64(i)
+    }
+    shift := uint(i >> hist_sub_bits - 1)
+    mantissa := uint64(i & (hist_sub_buckets - 1) + hist_sub_buckets)
+    return (mantissa + 1) << shift - 1
+}
+
+//
+// Method: Record
+//
+// Purpose: Counts one request's latency
+//
+func (h *Histogram) Record(d time.Duration) {
+    if d < 0 {
+        d = 0
+    }
+    h.counts[bucket_of(uint64(d))]++
+    if h.total == 0 || d < h.min {
+        h.min = d
+    }
+    if d > h.max {
+        h.max = d
+    }
+    h.total++
+    h.sum += d
+}
+
+//
+// Method: Merge
+//
+// Purpose: Adds the counts of another histogram
+//
+func (h *Histogram) Merge(o *Histogram) {
+    if o.total == 0 {
+        return
+    }
+    for i, n := range o.counts {
+        h.counts[i] += n
+    }
+    if h.total == 0 || o.min < h.min {
+        h.min = o.min
+    }
+    if o.max > h.max {
+        h.max = o.max
+    }
+    h.total += o.total
+    h.sum += o.sum
+}
+
+//
+// Method: Percentile
+//
+// Purpose: Returns the latency within which the fraction q of the requests completed
+//
+func (h *Histogram) Percentile(q float64) time.Duration {
+    if h.total == 0 {
+        return 0
+    }
+    rank := uint64(math.Ceil(q * float64(h.total)))
+    if rank < 1 {
+        rank = 1
+    }
+    var seen uint64
+    for i, n := range h.counts {
+        seen += n
+        if seen >= rank {
+            if limit := time.Duration(bucket_limit(i)); limit < h.max {
+                return limit
+            }
+            return h.max
+        }
+    }
+    return h.max
+}
+
+//
+// Method: Mean
+//
+// Purpose: Returns the mean latency
+//
+func (h *Histogram) Mean() time.Duration {
+    if h.total == 0 {
+        return 0
+    }
+    return h.sum / time.Duration(h.total)
+}
+
+//
+//  Bucket object - one bucket of the histogram in the report: the requests that took longer than
+//  the previous bucket's limit, and at most LimitUs microseconds
+//
+type Bucket struct {
+    LimitUs uint64 `json:"le_us"`
+    Count   uint64 `json:"count"`
+}
+
+//
+// Method: Buckets
+//
+// Purpose: Returns the histogram in power-of-two microsecond buckets, from the first bucket that
+//          counted any requests to the last
+//
+func (h *Histogram) Buckets() []Bucket {
+    var buckets []Bucket
+    for i, n := range h.counts {
+        if n == 0 {
+            continue
+        }
+        limit := uint64(1)
+        for bucket_limit(i) > limit * 1000 {
+            limit *= 2
+        }
+        if buckets == nil {
+            buckets = append(buckets, Bucket{LimitUs: limit})
+        }
+        for buckets[len(buckets) - 1].LimitUs < limit {
+            buckets = append(buckets, Bucket{LimitUs: buckets[len(buckets) - 1].LimitUs * 2})
+        }
+        buckets[len(buckets) - 1].Count += n
+    }
+    return buckets
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "math"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestBucketBoundaries(t *testing.T) {
+    // Small latencies are counted exactly
+    for ns := uint64(0); ns < hist_sub_buckets; ns++ {
+        if i := bucket_of(ns); i != int(ns) || bucket_limit(i) != ns {
+            t.Fatalf("%dns: bucket %d, limit %d", ns, i, bucket_limit(i))
+        }
+    }
+
+    // Each bucket starts just past the limit of the one before, up to the largest latency
+    last := bucket_of(math.MaxUint64)
+    if bucket_limit(last) != math.MaxUint64 {
+        t.Fatalf("last bucket %d has limit %d, want %d", last, bucket_limit(last), uint64(math.MaxUint64))
+    }
+    for i := 0; i < last; i++ {
+        limit := bucket_limit(i)
+        if bucket_of(limit) != i || bucket_of(limit + 1) != i + 1 {
+            t.Fatalf("bucket %d: limit %d is in bucket %d, and %d in bucket %d", i, limit, bucket_of(limit), limit + 1, bucket_of(limit + 1))
+        }
+        if i >= hist_sub_buckets {
+            if width := limit - bucket_limit(i - 1); float64(width) > float64(limit) / hist_sub_buckets {
+                t.Fatalf("bucket %d is %d wide, more than 1/%d of its limit %d", i, width, hist_sub_buckets, limit)
+            }
+        }
+    }
+
+    // Every power of two starts a bucket
+    for shift := uint(hist_sub_bits); shift < 64; shift++ {
+        ns := uint64(1) << shift
+        if i := bucket_of(ns); bucket_limit(i - 1) != ns - 1 {
+            t.Fatalf("%dns is not the first latency of bucket %d", ns, i)
+        }
+    }
+}
+
+func TestPercentile(t *testing.T) {
+    // Latencies of 1us to 10ms, one of each
+    var h Histogram
+    for us := 1; us <= 10000; us++ {
+        h.Record(time.Duration(us) * time.Microsecond)
+    }
+
+    for _, q := range []float64{0.001, 0.5, 0.9, 0.99, 0.999} {
+        want := time.Duration(math.Ceil(q * 10000)) * time.Microsecond
+        have := h.Percentile(q)
+        if have < want || float64(have - want) > float64(want) / hist_sub_buckets {
+            t.Errorf("p%g: %s, want %s to within 1/%d", q * 100, have, want, hist_sub_buckets)
+        }
+    }
+    if p := h.Percentile(1); p != 10 * time.Millisecond {
+        t.Errorf("p100: %s, want the maximum", p)
+    }
+    if h.min != time.Microsecond || h.max != 10 * time.Millisecond || h.Mean() != 5000500 * time.Nanosecond {
+        t.Errorf("min %s, max %s, mean %s", h.min, h.max, h.Mean())
+    }
+
+    // Merging two halves gives the same histogram
+    var low, high, merged Histogram
+    for us := 1; us <= 10000; us++ {
+        if us <= 5000 {
+            low.Record(time.Duration(us) * time.Microsecond)
+        } else {
+            high.Record(time.Duration(us) * time.Microsecond)
+        }
+    }
+    merged.Merge(&high)
+    merged.Merge(&low)
+    if merged != h {
+        t.Error("merged histogram differs from the whole")
+    }
+}
+
+func TestPickers(t *testing.T) {
+    defer func(saved string) { pattern = saved }(pattern)
+
+    for _, pattern = range []string{"sequential", "random", "zipfian", "hotspot"} {
+        for _, lines := range []uint64{1, 2, 10, 1000} {
+            counts := make([]int, lines + 1)
+            for id := 0; id < num_clients; id++ {
+                p := new_picker(id, lines)
+                for i := 0; i < 10000; i++ {
+                    line := p.Next()
+                    if line < 1 || line > lines {
+                        t.Fatalf("%s, %d lines: picked line %d", pattern, lines, line)
+                    }
+                    counts[line]++
+                }
+            }
+
+            // Line 1 is the most requested by the zipfian pattern, and the hot spot gets its share
+            switch {
+            case pattern == "zipfian" && lines > 2:
+                for line := uint64(2); line <= lines; line++ {
+                    if counts[line] > counts[1] {
+                        t.Errorf("%s, %d lines: line %d picked %d times, line 1 %d times", pattern, lines, line, counts[line], counts[1])
+                        break
+                    }
+                }
+            case pattern == "hotspot" && lines == 1000:
+                hot := 0
+                for line := 1; line <= int(hot_lines * 1000); line++ {
+                    hot += counts[line]
+                }
+                if share := float64(hot) / float64(num_clients * 10000); math.Abs(share - hot_share) > 0.02 {
+                    t.Errorf("%s: hot spot got %.3f of the requests, want %g", pattern, share, hot_share)
+                }
+            }
+        }
+    }
+}
+
+func TestReportFieldOrder(t *testing.T) {
+    defer func(saved string) { report_format = saved }(report_format)
+    report_format = "json"
+
+    var out bytes.Buffer
+    if err := write_report(&out, &Report{ErrorKinds: map[string]uint64{"timeout": 1, "eof": 2}}); err != nil {
+        t.Fatal(err)
+    }
+
+    // The top-level keys are written in a fixed order, whatever the content
+    var keys []string
+    dec := json.NewDecoder(&out)
+    dec.Token()
+    for dec.More() {
+        key, err := dec.Token()
+        if err != nil {
+            t.Fatal(err)
+        }
+        keys = append(keys, key.(string))
+        var value json.RawMessage
+        if err := dec.Decode(&value); err != nil {
+            t.Fatal(err)
+        }
+    }
+    want := []string{"server", "file", "lines", "clients", "pattern", "mode", "rate", "seed", "verified", "requests", "errors",
+        "error_kinds", "mismatches", "bytes", "duration_s", "throughput_rps", "latency_us", "histogram"}
+    if !reflect.DeepEqual(keys, want) {
+        t.Errorf("keys %v, want %v", keys, want)
+    }
+}
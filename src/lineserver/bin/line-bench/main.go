@@ -0,0 +1,527 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "lineserver/client"
+    "math"
+    "math/rand"
+    "net"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const usage = "usage: line-bench -p port [-m host] [-c clients] [-n requests | -duration secs] [-pattern sequential|random|zipfian|hotspot [-zipf-s s] [-hot-lines fraction -hot-share fraction]] [-rate requests_per_sec] [-timeout secs] [-t trim_mode] [-verify=false] [-seed n] [-format json|text] [-out file] filename"
+
+var server_host string
+var server_port int
+var num_clients int
+var num_requests int
+var run_secs float64
+var pattern string
+var zipf_s float64
+var hot_lines float64
+var hot_share float64
+var request_rate float64
+var request_timeout float64
+var trim_mode string
+var verify bool
+var seed int64
+var report_format string
+var report_file string
+
+//
+// Function: init
+//
+// Purpose: Create command line flags
+//
+func init() {
+    flag.StringVar(&server_host, "m", "localhost", "Line server hostname")
+    flag.IntVar(&server_port, "p", 0, "Line server port")
+    flag.IntVar(&num_clients, "c", 3, "Number of concurrent clients")
+    flag.IntVar(&num_requests, "n", 100, "Number of GET requests sent by each client (ignored with -duration)")
+    flag.Float64Var(&run_secs, "duration", 0, "Seconds to run for, instead of a number of requests")
+    flag.StringVar(&pattern, "pattern", "sequential", "Access pattern: sequential, random, zipfian or hotspot")
+    flag.Float64Var(&zipf_s, "zipf-s", 1.1, "Exponent of the zipfian distribution (> 1); line 1 is the most requested")
+    flag.Float64Var(&hot_lines, "hot-lines", 0.1, "Fraction of the file, from line 1, that is the hot spot")
+    flag.Float64Var(&hot_share, "hot-share", 0.9, "Fraction of the requests that go to the hot spot")
+    flag.Float64Var(&request_rate, "rate", 0, "Requests per second, across all clients (0 runs closed-loop: each client sends its next request as soon as it has a reply)")
+    flag.Float64Var(&request_timeout, "timeout", 10, "Seconds a request may take before it fails")
+    flag.StringVar(&trim_mode, "t", "space", "Line trimming of the server (its -t): space or exact")
+    flag.BoolVar(&verify, "verify", true, "Check every line returned against the file")
+    flag.Int64Var(&seed, "seed", 1, "Seed of the random access patterns, so that runs can be repeated")
+    flag.StringVar(&report_format, "format", "json", "Report format: json or text")
+    flag.StringVar(&report_file, "out", "", "File to write the report to (defaults to standard output)")
+}
+
+//
+//  SourceFile object and methods - the file being served, read independently of the server to
+//  verify the lines it returns
+//
+type SourceFile struct {
+    file    *os.File
+    offsets []int64     // Start of each line, and the end of the file
+}
+
+//
+// Function: open_source
+//
+// Purpose: Opens the source file, and finds its lines as the server indexes them: each LF ends a
+//          line, and a final line without one is a line too
+//
+func open_source(name string) (*SourceFile, error) {
+    f, err := os.Open(name)
+    if err != nil {
+        return nil, err
+    }
+
+    offsets := []int64{0}
+    buf := make([]byte, 64 * 1024)
+    var pos int64
+    for {
+        n, err := f.Read(buf)
+        for i := 0; i < n; {
+            j := bytes.IndexByte(buf[i:n], '\n')
+            if j < 0 {
+                break
+            }
+            i += j + 1
+            offsets = append(offsets, pos + int64(i))
+        }
+        pos += int64(n)
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            f.Close()
+            return nil, err
+        }
+    }
+    if pos > offsets[len(offsets) - 1] {
+        offsets = append(offsets, pos)
+    }
+    return &SourceFile{f, offsets}, nil
+}
+
+func (s *SourceFile) Lines() uint64 {
+    return uint64(len(s.offsets) - 1)
+}
+
+//
+// Method: Line
+//
+// Purpose: Returns a line as the server should serve it, trimmed according to its trim mode
+//
+func (s *SourceFile) Line(line uint64) ([]byte, error) {
+    start, end := s.offsets[line - 1], s.offsets[line]
+    b := make([]byte, end - start)
+    if _, err := s.file.ReadAt(b, start); err != nil {
+        return nil, err
+    }
+    if trim_mode == "exact" {
+        if len(b) > 0 && b[len(b) - 1] == '\n' {
+            b = b[:len(b) - 1]
+            if len(b) > 0 && b[len(b) - 1] == '\r' {
+                b = b[:len(b) - 1]
+            }
+        }
+        return b, nil
+    }
+    return bytes.TrimSpace(b), nil
+}
+
+//
+//  Picker object and methods - chooses the lines one client requests, by access pattern
+//
+type Picker struct {
+    lines uint64
+    rng   *rand.Rand
+    zipf  *rand.Zipf
+    next  uint64    // Next line of a sequential client
+    hot   uint64    // Last line of the hot spot
+}
+
+//
+// Function: new_picker
+//
+// Purpose: Returns the picker of client id. Sequential clients start at evenly spaced lines, so
+//          that they don't all request the same line at once.
+//
+func new_picker(id int, lines uint64) *Picker {
+    p := &Picker{lines: lines, rng: rand.New(rand.NewSource(seed + int64(id)))}
+    p.next = uint64(id) * lines / uint64(num_clients)
+    if pattern == "zipfian" {
+        p.zipf = rand.NewZipf(p.rng, zipf_s, 1, lines - 1)
+    }
+    p.hot = uint64(math.Ceil(hot_lines * float64(lines)))
+    if p.hot < 1 {
+        p.hot = 1
+    }
+    return p
+}
+
+//
+// Method: Next
+//
+// Purpose: Returns the next line to request
+//
+func (p *Picker) Next() uint64 {
+    switch pattern {
+    case "random":
+        return uint64(p.rng.Int63n(int64(p.lines))) + 1
+    case "zipfian":
+        return p.zipf.Uint64() + 1
+    case "hotspot":
+        if p.hot >= p.lines || p.rng.Float64() < hot_share {
+            return uint64(p.rng.Int63n(int64(p.hot))) + 1
+        }
+        return p.hot + uint64(p.rng.Int63n(int64(p.lines - p.hot))) + 1
+    }
+    line := p.next % p.lines + 1
+    p.next++
+    return line
+}
+
+//
+//  Worker object - the requests of one client, and their outcomes
+//
+type Worker struct {
+    picker     *Picker
+    latency    Histogram
+    requests   uint64
+    bytes      uint64
+    mismatches uint64
+    errors     map[string]uint64
+}
+
+//
+// Function: error_kind
+//
+// Purpose: Classifies a failed request for the report
+//
+func error_kind(err error) string {
+    switch err {
+    case client.ErrOutOfRange:
+        return "out_of_range"
+    case client.ErrMalformed:
+        return "malformed"
+    case client.ErrBusy:
+        return "busy"
+    case client.ErrShuttingDown:
+        return "shutting_down"
+    case context.DeadlineExceeded:
+        return "timeout"
+    }
+    if _, ok := err.(net.Error); ok {
+        return "network"
+    }
+    return "other"
+}
+
+//
+// GoRoutine: run_worker
+//
+// Purpose: Sends GET requests until the run ends: in closed-loop mode, each as soon as the last is
+//          answered; at a fixed rate, at the time given by each ticket. The latency of a ticketed
+//          request is measured from the time it was due, so a server that falls behind is charged
+//          for the requests it kept waiting.
+//
+func run_worker(w *Worker, c *client.Client, source *SourceFile, tickets <-chan time.Time, count int, end time.Time, wg *sync.WaitGroup) {
+    defer wg.Done()
+    timeout := time.Duration(request_timeout * float64(time.Second))
+
+    for i := 0; ; i++ {
+        var due time.Time
+        if tickets != nil {
+            var ok bool
+            if due, ok = <-tickets; !ok {
+                return
+            }
+        } else {
+            due = time.Now()
+            if (end.IsZero() && i >= count) || (!end.IsZero() && !due.Before(end)) {
+                return
+            }
+        }
+
+        line := w.picker.Next()
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        text, err := c.Get(ctx, line)
+        w.latency.Record(time.Since(due))
+        cancel()
+
+        w.requests++
+        if err != nil {
+            kind := error_kind(err)
+            if w.errors[kind] == 0 {
+                fmt.Fprintf(os.Stderr, "GET %d failed: %s\n", line, err)
+            }
+            w.errors[kind]++
+            continue
+        }
+        w.bytes += uint64(len(text))
+
+        if verify {
+            want, err := source.Line(line)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to read line %d of the source file: %s\n", line, err)
+                w.errors["source"]++
+            } else if !bytes.Equal(text, want) {
+                if w.mismatches == 0 {
+                    fmt.Fprintf(os.Stderr, "GET %d returned %d bytes that differ from the source file's %d\n", line, len(text), len(want))
+                }
+                w.mismatches++
+            }
+        }
+    }
+}
+
+//
+// GoRoutine: issue_tickets
+//
+// Purpose: Issues the due time of each request of a fixed-rate run, until count requests have been
+//          issued, or the run ends. A ticket waits for a free client; its due time does not, so
+//          requests held up by busy clients are issued back to back until the schedule catches up.
+//
+func issue_tickets(tickets chan<- time.Time, count int, end time.Time) {
+    defer close(tickets)
+    interval := time.Duration(float64(time.Second) / request_rate)
+    start := time.Now()
+    for i := 0; !end.IsZero() || i < count; i++ {
+        due := start.Add(time.Duration(i) * interval)
+        if !end.IsZero() && !due.Before(end) {
+            return
+        }
+        if wait := time.Until(due); wait > 0 {
+            time.Sleep(wait)
+            due = time.Now()    // Oversleeping is not the server's delay
+        }
+        tickets <- due
+    }
+}
+
+//
+//  Report object - the outcome of a run, as written in JSON. Fields are in a fixed order, so that
+//  reports of different builds can be diffed.
+//
+type Report struct {
+    Server        string            `json:"server"`
+    File          string            `json:"file"`
+    Lines         uint64            `json:"lines"`
+    Clients       int               `json:"clients"`
+    Pattern       string            `json:"pattern"`
+    Mode          string            `json:"mode"`
+    Rate          float64           `json:"rate"`
+    Seed          int64             `json:"seed"`
+    Verified      bool              `json:"verified"`
+    Requests      uint64            `json:"requests"`
+    Errors        uint64            `json:"errors"`
+    ErrorKinds    map[string]uint64 `json:"error_kinds"`
+    Mismatches    uint64            `json:"mismatches"`
+    Bytes         uint64            `json:"bytes"`
+    DurationSecs  float64           `json:"duration_s"`
+    Throughput    float64           `json:"throughput_rps"`
+    Latency       Latency           `json:"latency_us"`
+    Histogram     []Bucket          `json:"histogram"`
+}
+
+type Latency struct {
+    Min  float64 `json:"min"`
+    Mean float64 `json:"mean"`
+    P50  float64 `json:"p50"`
+    P90  float64 `json:"p90"`
+    P99  float64 `json:"p99"`
+    P999 float64 `json:"p999"`
+    Max  float64 `json:"max"`
+}
+
+//
+// Function: microseconds
+//
+// Purpose: Converts a latency to microseconds, to a tenth of a microsecond
+//
+func microseconds(d time.Duration) float64 {
+    return math.Round(float64(d) / 100) / 10
+}
+
+//
+// Function: write_report
+//
+// Purpose: Writes the report as indented JSON, or as a summary for people
+//
+func write_report(w io.Writer, r *Report) error {
+    if report_format == "json" {
+        b, err := json.MarshalIndent(r, "", "  ")
+        if err != nil {
+            return err
+        }
+        _, err = w.Write(append(b, '\n'))
+        return err
+    }
+
+    _, err := fmt.Fprintf(w, "%s: %d lines of %s\n", r.Server, r.Lines, r.File)
+    fmt.Fprintf(w, "%d clients, %s access, %s", r.Clients, r.Pattern, r.Mode)
+    if r.Rate > 0 {
+        fmt.Fprintf(w, " at %g requests/s", r.Rate)
+    }
+    fmt.Fprintf(w, "\n%d requests in %.3fs: %.1f requests/s, %d bytes\n", r.Requests, r.DurationSecs, r.Throughput, r.Bytes)
+    fmt.Fprintf(w, "%d errors %v, %d mismatches (verified: %t)\n", r.Errors, r.ErrorKinds, r.Mismatches, r.Verified)
+    l := r.Latency
+    fmt.Fprintf(w, "latency (us): min %.1f  mean %.1f  p50 %.1f  p90 %.1f  p99 %.1f  p999 %.1f  max %.1f\n",
+        l.Min, l.Mean, l.P50, l.P90, l.P99, l.P999, l.Max)
+    for _, b := range r.Histogram {
+        fmt.Fprintf(w, "  <= %8d us  %d\n", b.LimitUs, b.Count)
+    }
+    return err
+}
+
+//
+// Function: main
+//
+// Purpose: Runs the clients against the line server, and reports the outcome. Exits with status 1
+//          if any request failed, or returned a line that differs from the file.
+//
+func main() {
+    flag.Parse()
+
+    if flag.NArg() != 1 {
+        fmt.Fprintln(os.Stderr, usage)
+        os.Exit(2)
+    }
+    switch {
+    case server_port < 1 || server_port > 65535:
+        fmt.Fprintf(os.Stderr, "Missing or invalid server port: %d\n", server_port)
+    case num_clients < 1 || num_requests < 1 || run_secs < 0 || request_rate < 0 || request_timeout <= 0:
+        fmt.Fprintln(os.Stderr, "Invalid number of clients, requests, duration, rate or timeout")
+    case pattern != "sequential" && pattern != "random" && pattern != "zipfian" && pattern != "hotspot":
+        fmt.Fprintf(os.Stderr, "Invalid access pattern: %s\n", pattern)
+    case zipf_s <= 1 || hot_lines <= 0 || hot_lines > 1 || hot_share < 0 || hot_share > 1:
+        fmt.Fprintln(os.Stderr, "Invalid zipfian exponent or hot spot")
+    case trim_mode != "space" && trim_mode != "exact":
+        fmt.Fprintf(os.Stderr, "Invalid trim mode: %s\n", trim_mode)
+    case report_format != "json" && report_format != "text":
+        fmt.Fprintf(os.Stderr, "Invalid report format: %s\n", report_format)
+    default:
+        os.Exit(run(flag.Arg(0)))
+    }
+    os.Exit(2)
+}
+
+//
+// Function: run
+//
+// Purpose: Runs the benchmark, and returns the exit status
+//
+func run(filename string) int {
+    source, err := open_source(filename)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Unable to read source file:", err)
+        return 2
+    }
+    defer source.file.Close()
+
+    addr := net.JoinHostPort(server_host, strconv.Itoa(server_port))
+    c := client.New(addr, client.Options{MaxConns: num_clients, MaxIdle: num_clients})
+    defer c.Close()
+
+    // The server must be serving the same file
+    ctx, cancel := context.WithTimeout(context.Background(), time.Duration(request_timeout * float64(time.Second)))
+    lines, err := c.Count(ctx)
+    cancel()
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Unable to reach the line server at %s: %s\n", addr, err)
+        return 2
+    }
+    if lines != source.Lines() {
+        fmt.Fprintf(os.Stderr, "The server has %d lines, but %s has %d\n", lines, filename, source.Lines())
+        return 2
+    }
+    if lines == 0 {
+        fmt.Fprintln(os.Stderr, "The file has no lines to request")
+        return 2
+    }
+
+    var end time.Time
+    start := time.Now()
+    if run_secs > 0 {
+        end = start.Add(time.Duration(run_secs * float64(time.Second)))
+    }
+    var tickets chan time.Time
+    mode := "closed-loop"
+    if request_rate > 0 {
+        mode = "fixed-rate"
+        tickets = make(chan time.Time, num_clients)
+        go issue_tickets(tickets, num_clients * num_requests, end)
+    }
+
+    workers := make([]*Worker, num_clients)
+    var wg sync.WaitGroup
+    for i := range workers {
+        workers[i] = &Worker{picker: new_picker(i, lines), errors: map[string]uint64{}}
+        wg.Add(1)
+        go run_worker(workers[i], c, source, tickets, num_requests, end, &wg)
+    }
+    wg.Wait()
+    elapsed := time.Since(start)
+
+    // Merge the outcomes of the clients
+    r := &Report{
+        Server:       addr,
+        File:         filename,
+        Lines:        lines,
+        Clients:      num_clients,
+        Pattern:      pattern,
+        Mode:         mode,
+        Rate:         request_rate,
+        Seed:         seed,
+        Verified:     verify,
+        ErrorKinds:   map[string]uint64{},
+        DurationSecs: math.Round(elapsed.Seconds() * 1000) / 1000,
+    }
+    var latency Histogram
+    for _, w := range workers {
+        latency.Merge(&w.latency)
+        r.Requests += w.requests
+        r.Bytes += w.bytes
+        r.Mismatches += w.mismatches
+        for kind, n := range w.errors {
+            r.ErrorKinds[kind] += n
+            r.Errors += n
+        }
+    }
+    r.Throughput = math.Round(float64(r.Requests) / elapsed.Seconds() * 10) / 10
+    r.Latency = Latency{
+        Min:  microseconds(latency.min),
+        Mean: microseconds(latency.Mean()),
+        P50:  microseconds(latency.Percentile(0.5)),
+        P90:  microseconds(latency.Percentile(0.9)),
+        P99:  microseconds(latency.Percentile(0.99)),
+        P999: microseconds(latency.Percentile(0.999)),
+        Max:  microseconds(latency.max),
+    }
+    r.Histogram = latency.Buckets()
+
+    out := os.Stdout
+    if report_file != "" {
+        if out, err = os.Create(report_file); err != nil {
+            fmt.Fprintln(os.Stderr, "Unable to create report:", err)
+            return 2
+        }
+        defer out.Close()
+    }
+    if err := write_report(out, r); err != nil {
+        fmt.Fprintln(os.Stderr, "Unable to write report:", err)
+        return 2
+    }
+
+    if r.Errors > 0 || r.Mismatches > 0 {
+        return 1
+    }
+    return 0
+}
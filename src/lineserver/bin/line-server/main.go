@@ -1,80 +1,45 @@
 package main
 
 import (
-    "bufio"
-    "encoding/binary"
+    "context"
     "flag"
     "fmt"
-    "io"
+    "lineserver"
+    "log"
     "net"
     "os"
-    "regexp"
+    "os/signal"
     "strconv"
-    "strings"
-    "sync"
+    "syscall"
     "time"
 )
 
-const usage  = "usage: lineserver -p port [-t max_threads] filename"
+const usage  = "usage: lineserver -p port [-c max_clients [-a queue|reject] [-q queue_timeout]] [-d drain_timeout] [-idle idle_timeout] [-write-timeout secs] [-shutdown policy [-admin-token token] [-admin-addr addr]] [-binary-addr addr] [-http-addr addr] [-resp-addr addr] [-memcache-addr addr] [-z zones] [-o owners] [-i index_mode] [-m index_budget_mb] [-b chunk_kb] [-t trim_mode] [-f poll_ms [-tail-timeout secs]] [-r] filename"
 
 var listen_port int
 var max_clients int
-var total_clients uint64
-
-//
-//  ServerState object and methods - convenience object for managing the server
-//
-type ServerState struct {
-    rw_lock *sync.RWMutex
-    shutdown bool
-    wg *sync.WaitGroup
-}
-
-func (s *ServerState) IsShutdown() bool {
-    s.rw_lock.RLock()
-    state := s.shutdown
-    s.rw_lock.RUnlock()
-    return state
-}
-
-func (s *ServerState) InitiateShutdown() {
-    s.rw_lock.Lock()
-    s.shutdown = true
-    s.rw_lock.Unlock()
-}
-
-func (s *ServerState) Starting() {
-    s.wg.Add(1)
-}
-
-func (s *ServerState) Done() {
-    s.wg.Done()
-}
-
-func (s *ServerState) Wait() {
-    s.wg.Wait()
-}
-
-//
-//  ClientConfig object and methods - contains common client config info
-//
-type ClientConfig struct {
-    source string
-    index  string
-    lines  uint64
-}
-
-func (c *ClientConfig) GetSource() string {
-    return c.source
-}
-
-func (c *ClientConfig) GetIndex() string {
-    return c.index
-}
-
-func (c *ClientConfig) GetLines() uint64 {
-    return c.lines
-}
+var rebuild_index bool
+var num_zones int
+var zone_owners int
+var index_mode string
+var index_budget uint64
+var chunk_kb int
+var admit_policy string
+var queue_timeout int
+var drain_timeout int
+var idle_timeout int
+var shutdown_policy string
+var admin_token string
+var admin_addr string
+var binary_addr string
+var http_addr string
+var resp_addr string
+var memcache_addr string
+var follow_interval int
+var tail_timeout int
+var write_timeout int
+var trim_mode string
+const admin_token_env = "LINE_SERVER_ADMIN_TOKEN"
 
 //
 // Function: init
@@ -84,286 +49,89 @@ func (c *ClientConfig) GetLines() uint64 {
 func init() {
     flag.IntVar(&listen_port, "p", 0, "Port number on which to listen for connections")
     flag.IntVar(&max_clients, "c", 0, "Maximum number of concurrent client connections (defaults to unnlimited)")
-}
-
-//
-// Function: create_file_index
-//
-// Purpose: Create file index
-//
-func create_file_index(source_file string) (string, uint64) {
-    // Open the source file
-    fmt.Printf("Opening source file '%s'\n", source_file)
-    src, err := os.Open(source_file)
-    if err != nil {
-        fmt.Println(err)
-        return "", uint64(0)
-    }
-
-    // Create/truncate an index file
-    index_file := source_file + ".idx"
-    fmt.Printf("Opening index file '%s'\n", index_file)
-    idx, err := os.Create(index_file)
-    if err != nil {
-        fmt.Println(err)
-        src.Close()
-        return "", uint64(0)
-    }
-
-    defer func() {
-        src.Close()
-        idx.Close()
-    }()
-
-    // Find and mark line beginnings in the source file
-    var offset, lines uint64
-    var output [2]uint64
-    var eol, next, rollover, length int
-    var w_err error
-    var done bool
-
-    fmt.Println("Searching source file for line endings...")
-
-    buffer := make([]byte, 4096)    // Typical Linux page size
-    for !done {
-
-        n, err := src.Read(buffer);
-        if err != nil {
-            if err == io.EOF {
-                break
+    flag.BoolVar(&rebuild_index, "r", false, "Rebuild the index file even if the existing one matches the source file")
+    flag.IntVar(&num_zones, "z", 0, "Number of zones the source file is divided into (defaults to automatic sizing)")
+    flag.IntVar(&zone_owners, "o", 1, "Number of owner GoRoutines per zone")
+    flag.StringVar(&index_mode, "i", lineserver.IndexAuto, "Index access mode: auto, memory, mmap or disk")
+    flag.Uint64Var(&index_budget, "m", 256, "Memory budget for an in-memory index, in megabytes (used by -i auto)")
+    flag.StringVar(&trim_mode, "t", lineserver.TrimSpace, "Line trimming: space (strip leading and trailing whitespace) or exact (strip only the LF or CRLF)")
+    flag.IntVar(&chunk_kb, "b", 64, "Size of the chunks in which lines are copied to clients, in kilobytes")
+    flag.StringVar(&admit_policy, "a", lineserver.AdmitQueue, "Admission policy when -c clients are connected: queue or reject")
+    flag.IntVar(&queue_timeout, "q", 30, "Seconds a queued client waits for a free slot before it is sent BUSY (0 waits indefinitely)")
+    flag.IntVar(&drain_timeout, "d", 10, "Seconds in-flight requests are given to finish at shutdown, before their connections are closed")
+    flag.IntVar(&idle_timeout, "idle", 0, "Seconds a client may be idle before it is disconnected (0 never disconnects idle clients)")
+    flag.StringVar(&shutdown_policy, "shutdown", lineserver.ShutdownOff, "Who may use SHUTDOWN: off, loopback, token or admin")
+    flag.StringVar(&admin_token, "admin-token", os.Getenv(admin_token_env), "Token required by SHUTDOWN <token> under -shutdown token (defaults to $" + admin_token_env + ")")
+    flag.StringVar(&admin_addr, "admin-addr", "", "Address of a separate admin listener, e.g. 127.0.0.1:7000 (required by -shutdown admin)")
+    flag.StringVar(&binary_addr, "binary-addr", "", "Address of a listener for the binary protocol, e.g. :6667")
+    flag.StringVar(&http_addr, "http-addr", "", "Address of a listener for the HTTP gateway, e.g. :8080")
+    flag.StringVar(&resp_addr, "resp-addr", "", "Address of a listener for Redis (RESP) clients, e.g. :6379")
+    flag.StringVar(&memcache_addr, "memcache-addr", "", "Address of a listener for memcached (ASCII protocol) clients, e.g. :11211")
+    flag.IntVar(&follow_interval, "f", 0, "Follow the source file for appended lines, polling it every so many milliseconds (0 disables follow mode)")
+    flag.IntVar(&tail_timeout, "tail-timeout", 30, "Seconds a TAIL client may accept no data before it is disconnected (0 waits indefinitely)")
+    flag.IntVar(&write_timeout, "write-timeout", 30, "Seconds any other client may accept no data before it is disconnected (0 waits indefinitely)")
+}
+
+//
+// Function: handle_signals
+//
+// Purpose: Starts a graceful shutdown on the first SIGINT or SIGTERM. A second signal skips the
+//          drain deadline, and closes all client connections at once. SIGHUP reloads the source file.
+//
+func handle_signals(srv *lineserver.Server, drain time.Duration) {
+    reloads := make(chan os.Signal, 1)
+    signal.Notify(reloads, syscall.SIGHUP)
+    go func() {
+        for range reloads {
+            fmt.Println("Received SIGHUP: reloading source file")
+            if err := srv.Reload(); err != nil {
+                fmt.Println("Reload failed:", err)
             }
-            fmt.Println(err)
-            return "", uint64(0)
         }
-        fmt.Printf("Read %d bytes\n", n)
-
-        for s := string(buffer)[:n]; eol >= 0; {
-            eol = strings.IndexByte(s, '\n')
-            if eol >= 0 {
-                fmt.Printf("nl-index %d  rollover %d\n", eol, rollover)
-
-                next = eol + 1  // String index of the start of the next line, relative to the current buffer
-                length = next + rollover   // Length of this string, in bytes. Includes any rollover from the previous buffer
-                rollover = 0
-
-                // Write index/size of line into index file
-                output[0] = offset
-                output[1]  = uint64(length)
-                w_err = binary.Write(idx, binary.LittleEndian, output)
-                if w_err != nil {
-                    fmt.Println("binary.Write failed:", w_err)
-                    break
-                }
+    }()
 
-                fmt.Printf("Line %d: offset %d  length %d  eol %d  next %d\n", lines, output[0], output[1], eol, next)
-                fmt.Printf("Line %d: %s\n", lines, s[:length])
+    signals := make(chan os.Signal, 2)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-                offset += uint64(length)    // Offset is relative to the beginning of the file, in bytes
-                lines++
-                if next >= len(s) {
-                    break
-                }
-                s = s[next:]                // Slice the string so that it starts at the beginning of the next line
-            } else {
-                rollover = len(s)   // Remember how many characters were leftover in the previous buffer (i.e., a partial line)
-            }
-        }
-        eol = 0
-        fmt.Printf("Buffer rollover: %d\n", rollover)
-    }
+    go func() {
+        sig := <-signals
+        fmt.Printf("Received %s: shutting down\n", sig)
+        go shutdown(srv, drain)
 
-    return index_file, lines
+        sig = <-signals
+        fmt.Printf("Received %s: closing all client connections\n", sig)
+        srv.Close()
+    }()
 }
 
 //
-// Function: get_text
+// Function: shutdown
 //
-// Purpose: Retrieves the text associated with the specified line number
+// Purpose: Shuts the server down, giving busy clients until the drain deadline to finish
 //
-func get_text(src *os.File, idx *os.File, line uint64, total_lines uint64) string {
-    // Sanity check the requested lines against the total number of lines available
-    if line < 1 || line > total_lines {
-        fmt.Printf("Requested line %d is out of range: { 1, %d }\n", line, total_lines)
-        return ""
-    }
-
-    var offset uint64 = (line - 1) * (8 * 2)
-
-    fmt.Printf("get_text: line %d  total_lines %d  offset %d\n", line, total_lines, offset)
-
-    // Seek to the correct location in the index file
-    _, err := idx.Seek(int64(offset), 0)
-    if err != nil {
-        fmt.Println("Index Seek failed: ", err)
-        return ""
-    }
-
-    var location [2]uint64
-
-    // Retrieve the offset and length of the requested line
-    err2 := binary.Read(idx, binary.LittleEndian, &location)
-    if err2 != nil {
-        fmt.Println("Index binary.Read failed:", err2)
-        return ""
-    }
-
-    fmt.Printf("get_text: source offset %d  length %d\n", location[0], location[1])
-
-    // Seek to the correct location in the source file
-    _, err3 := src.Seek(int64(location[0]), 0)
-    if err3 != nil {
-        fmt.Println("Source Seek failed: ", err3)
-        return ""
-    }
-
-    // Retrieve the requested line's text
-    text := make([]byte, location[1])
-    n, err4 := src.Read(text)
-    if err4 != nil {
-        fmt.Println("Source Read failed:", err4)
-        return ""
-    }
-    if n != int(location[1]) {
-        fmt.Printf("Source Read returned %d bytes which is not equal to the requested byte count of %d bytes\n", n, location[1])
-        return ""
-    }
-
-    fmt.Printf("get_text: Read %d bytes at offset %d: %s\n", n, location[0], string(text))
-
-    return string(text)
+func shutdown(srv *lineserver.Server, drain time.Duration) {
+    ctx, cancel := context.WithTimeout(context.Background(), drain)
+    defer cancel()
+    srv.Shutdown(ctx)
 }
 
 //
-// GoRoutine: client_handler
+// Function: listen
 //
-// Purpose: Validates and executes client commands
+// Purpose: Serves one of the optional listeners, if its address was given. Returns false if the
+//          listener can't be opened.
 //
-func client_handler(client net.Conn, timeout int, state *ServerState, cfg *ClientConfig) {
-    // client handler closure
-    defer func() {
-        fmt.Printf("Closing socket to %s\n", client.RemoteAddr().String())
-        client.Close()  // Close client socket
-        state.Done()    // Decrement the WaitGroup
-    }()
-
-    validCommand := regexp.MustCompile(`(^GET (\d+)\r\n$|^QUIT\r\n$|^SHUTDOWN\r\n$)`)
-    timeoutDuration := time.Duration(timeout) * time.Second
-    reader := bufio.NewReader(client)
-    done := false
-    reply := "Huh?\r\n"
-//    w = bufio.NewWriter(conn)
-
-    // Open the source file
-    src, err := os.Open(cfg.GetSource())
-    if err != nil {
-        fmt.Println(err)
-        return
+func listen(name string, addr string, serve func(net.Listener) error) bool {
+    if addr == "" {
+        return true
     }
-
-    // Open the index file
-    idx, err := os.Open(cfg.GetIndex())
+    conn, err := net.Listen("tcp", addr)
     if err != nil {
-        fmt.Println(err)
-        src.Close()
-        return
-    }
-
-    // Client command-response loop
-    for !done {
-        // Set max read timeout
-        client.SetReadDeadline(time.Now().Add(timeoutDuration))
-
-        msg, err := reader.ReadString('\n')
-        if err != nil {
-            // Use timeout event as opportunity to check for server shutdown
-            if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-                if (!state.IsShutdown()) {
-                    continue
-                }
-                fmt.Println("Client received shutdown signal")
-            } else {
-                fmt.Println("Client read error: ", err)
-            }
-            break
-        }
-
-        // Regex match command string
-        s := validCommand.FindStringSubmatch(string(msg))
-        if len(s) != 3 {
-            client.Write([]byte("ERR\r\n"))
-            continue
-        }
-        cmd := strings.TrimSpace(s[1]);
-
-        switch cmd {
-        case "QUIT":
-            fmt.Println("Command: QUIT")
-            done = true
-        case "SHUTDOWN":
-            fmt.Println("Command: SHUTDOWN")
-            done = true
-            state.InitiateShutdown() // Signal server to exit
-        default:    // Per regex matching, this can only be the GET nnnn command
-            fmt.Println("Command: " + cmd)
-            if line, err2 := strconv.ParseUint(s[2], 10, 64); err2 == nil {
-                text := get_text(src, idx, line, cfg.GetLines())
-                if text != "" {
-                    text = strings.TrimSpace(text)
-                    reply = "OK\r\n" + text + "\r\n"
-                } else {
-                    reply  = "ERR\r\n"
-                }
-            } else {
-                reply = "ERR\r\n"
-            }
-            fmt.Printf("Sending: " + reply)
-            client.Write([]byte(reply))
-//            client.Flush()
-        }
-    }
-}
-
-//
-// Function: wait_for_clients
-//
-// Purpose: Waits for client connections. Dispatches one new client_handler per client connection.
-//
-func wait_for_clients(listen_conn net.Listener, timeout int, state *ServerState, cfg *ClientConfig) {
-
-    tcplistener := listen_conn.(*net.TCPListener)
-
-    // Listener closure
-    defer func() {
-        fmt.Printf("Closing listener on %s:%s\n", listen_conn.Addr().Network(), listen_conn.Addr().String())
-        listen_conn.Close() // Close listener socket
-    }()
-
-    fmt.Printf("Listening for clients on %s:%s\n", listen_conn.Addr().Network(), listen_conn.Addr().String())
-
-    // Main loop for launching new clients
-    for {
-	    tcplistener.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
-
-        client, err := listen_conn.Accept()
-        if err != nil {
-            // Use timeout event as opportunity to check for server shutdown
-            if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-                if (!state.IsShutdown()) {
-                    continue
-                }
-                fmt.Println("Listener received shutdown signal")
-            } else {
-                fmt.Println("Accept error: ", err)
-                state.InitiateShutdown()    // Signal server to exit
-            }
-            break
-        }
-
-        // Launch new client handler
-        fmt.Printf("Connection from %s\n", client.RemoteAddr().String())
-        state.Starting() // Increment the WaitGroup
-        go client_handler(client, 10, state, cfg)
+        fmt.Printf("%s listen error: %s\n", name, err)
+        return false
     }
+    go serve(conn)
+    return true
 }
 
 //
@@ -375,7 +143,7 @@ func main() {
     // Parse command line
     flag.Parse()
 
-    // Validate command line flags and arguments
+    // Validate command line flags and arguments; the options themselves are checked by NewServer
     if flag.NFlag() < 1 || flag.NArg() != 1 {
         fmt.Println(usage)
         return
@@ -384,19 +152,50 @@ func main() {
         fmt.Printf("Missing or invalid listening port: %d\n", listen_port)
         return
     }
-    // max_clients is optional and defaults to zero; which means unlimited goroutines
-    if max_clients < 0 {
-        fmt.Printf("Invalid maximum number of clients: %d\n", max_clients)
+    if drain_timeout < 0 {
+        fmt.Printf("Invalid drain timeout: %d\n", drain_timeout)
+        return
+    }
+    if shutdown_policy == lineserver.ShutdownAdmin && admin_addr == "" {
+        fmt.Printf("-shutdown %s requires -admin-addr\n", lineserver.ShutdownAdmin)
+        return
+    }
+    if chunk_kb < 1 {
+        fmt.Printf("Invalid chunk size: %dKB\n", chunk_kb)
         return
     }
 
-    // Pre-process the specified text file
-    fmt.Printf("Creating file index on '%s'\n", flag.Arg(0))
+    opts := lineserver.Options{
+        MaxClients:     max_clients,
+        AdmitPolicy:    admit_policy,
+        QueueTimeout:   time.Duration(queue_timeout) * time.Second,
+        IdleTimeout:    time.Duration(idle_timeout) * time.Second,
+        TailTimeout:    time.Duration(tail_timeout) * time.Second,
+        WriteTimeout:   time.Duration(write_timeout) * time.Second,
+        ShutdownPolicy: shutdown_policy,
+        AdminToken:     admin_token,
+        Zones:          num_zones,
+        Owners:         zone_owners,
+        IndexMode:      index_mode,
+        IndexBudget:    index_budget * 1024 * 1024,
+        ChunkSize:      chunk_kb * 1024,
+        TrimMode:       trim_mode,
+        Rebuild:        rebuild_index,
+        FollowInterval: time.Duration(follow_interval) * time.Millisecond,
+        Logger:         log.New(os.Stdout, "", 0),  // Progress messages go to stdout
+    }
+    if opts.ShutdownPolicy == lineserver.ShutdownToken && opts.AdminToken == "" {
+        fmt.Printf("-shutdown %s requires -admin-token or $%s\n", lineserver.ShutdownToken, admin_token_env)
+        return
+    }
 
-    index_file, lines := create_file_index(flag.Arg(0))
-    if index_file == "" {
+    // Index and open the specified text file, and start its zone owners
+    srv, err := lineserver.NewServer(flag.Arg(0), opts)
+    if err != nil {
+        fmt.Println("Unable to start server:", err)
         return
     }
+    drain := time.Duration(drain_timeout) * time.Second
 
     fmt.Printf("Creating listener on port %d\n", listen_port)
 
@@ -404,23 +203,31 @@ func main() {
     listen_conn, err := net.Listen("tcp4", listen_addr)
     if err != nil {
         fmt.Println("Listen error: ", err)
+        shutdown(srv, drain)
         return
     }
 
-    // Instantiate our server management object
-    state := ServerState{new(sync.RWMutex), false, new(sync.WaitGroup)}
+    // SIGINT and SIGTERM start the same drain as the SHUTDOWN command; SIGHUP reloads the source file
+    handle_signals(srv, drain)
 
-    // Instantiate client config object
-    cfg := ClientConfig{flag.Arg(0), index_file, lines}
+    // Accept admin, binary, Redis, memcached and HTTP clients on their own listeners, if requested
+    if !listen("Admin", admin_addr, srv.ServeAdmin) || !listen("Binary", binary_addr, srv.ServeBinary) ||
+        !listen("RESP", resp_addr, srv.ServeRESP) || !listen("Memcache", memcache_addr, srv.ServeMemcache) ||
+        !listen("HTTP", http_addr, srv.ServeGateway) {
+        listen_conn.Close()
+        shutdown(srv, drain)
+        return
+    }
 
     // Wait for new client connections until the SHTUDOWN is received by one of the clients
-    wait_for_clients(listen_conn, 2, &state, &cfg)
+    srv.Serve(listen_conn)
 
     fmt.Println("Server waiting on all outstanding GoRoutines to exit...")
 
-    state.Wait()   // Wait for all goroutines to exit
+    shutdown(srv, drain)    // Wait for all goroutines to exit
 
-    fmt.Println("Server shutting down")
+    _, peak, total := srv.Clients()
+    fmt.Printf("Server shutting down: served %d clients, peak %d concurrent\n", total, peak)
 
     os.Exit(0)
 }
@@ -0,0 +1,379 @@
+package lineserver
+
+import (
+    "bufio"
+    "encoding/binary"
+    "io"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+//
+//  Binary protocol. Every request starts with a fixed-size binaryRequest header, and every
+//  response frame with a fixed-size binaryResponse header followed by Length bytes of line text
+//  (without any line terminator). All values are little-endian.
+//
+//  Requests are served concurrently, and their responses are written as soon as they are ready,
+//  so responses may arrive out of order; the request id ties each response to its request. The
+//  frames of one response are never interleaved with another's. A response of several frames
+//  (RANGE, MGET) sets binary_more on every frame but the last.
+//
+const binary_version uint8 = 1
+const binary_header_size = 24      // binary.Size(binaryRequest{}) and binary.Size(binaryResponse{})
+const binary_window = 64           // Requests of one connection in progress at once
+const binary_max_mget = 64 * 1024  // Most line numbers in one MGET request
+
+const (
+    op_get   uint8 = 1  // Line: the line number
+    op_range uint8 = 2  // Line: the first line number; Count: the number of lines
+    op_mget  uint8 = 3  // Count: the number of uint64 line numbers that follow the header
+    op_count uint8 = 4  // Replies with the number of lines in Line
+    op_ping  uint8 = 5
+    op_quit  uint8 = 6  // Closes the connection once all responses have been sent; no response
+)
+
+const (
+    status_ok           uint8 = 0
+    status_out_of_range uint8 = 1
+    status_malformed    uint8 = 2  // Unknown opcode, bad count, or unsupported version
+    status_shutdown     uint8 = 3  // The server is shutting down; the request was not served
+    status_error        uint8 = 4  // The line could not be read
+    status_busy         uint8 = 5  // Sent, with request id 0, to a client turned away by admission control
+)
+
+const binary_more uint8 = 1     // binaryResponse.Flags: more frames of this response follow
+
+//
+//  binaryRequest object - fixed-size header of a binary protocol request
+//
+type binaryRequest struct {
+    Version  uint8
+    Opcode   uint8
+    Reserved uint16
+    Id       uint32
+    Line     uint64
+    Count    uint64
+}
+
+//
+//  binaryResponse object - fixed-size header of a binary protocol response frame
+//
+type binaryResponse struct {
+    Version uint8
+    Opcode  uint8
+    Status  uint8
+    Flags   uint8
+    Id      uint32
+    Line    uint64  // Line number of the text that follows; the line count for op_count
+    Length  uint64  // Bytes of line text that follow
+}
+
+func (r *binaryRequest) decode(b []byte) {
+    r.Version = b[0]
+    r.Opcode = b[1]
+    r.Reserved = binary.LittleEndian.Uint16(b[2:4])
+    r.Id = binary.LittleEndian.Uint32(b[4:8])
+    r.Line = binary.LittleEndian.Uint64(b[8:16])
+    r.Count = binary.LittleEndian.Uint64(b[16:24])
+}
+
+func (r *binaryResponse) encode(b []byte) {
+    b[0] = r.Version
+    b[1] = r.Opcode
+    b[2] = r.Status
+    b[3] = r.Flags
+    binary.LittleEndian.PutUint32(b[4:8], r.Id)
+    binary.LittleEndian.PutUint64(b[8:16], r.Line)
+    binary.LittleEndian.PutUint64(b[16:24], r.Length)
+}
+
+var binary_protocol = &protocol{"binary", binary_handler, binary_busy()}
+
+//
+// Function: binary_busy
+//
+// Purpose: Encodes the frame sent to a binary client that is turned away by admission control
+//
+func binary_busy() []byte {
+    b := make([]byte, binary_header_size)
+    (&binaryResponse{Version: binary_version, Status: status_busy}).encode(b)
+    return b
+}
+
+//
+//  binaryConn object and methods - the response side of one binary protocol connection. Whole
+//  responses are written under lock, so that their frames are never interleaved.
+//
+type binaryConn struct {
+    client  net.Conn
+    writer  *bufio.Writer
+    lock    *sync.Mutex
+    zones   *zoneSet
+    pending *sync.WaitGroup
+    window  chan struct{}   // One token per request in progress
+    queued  int32           // Responses waiting for the lock; updated atomically
+}
+
+//
+// Method: acquire
+//
+// Purpose: Takes the lock, to write a whole response
+//
+func (b *binaryConn) acquire() {
+    atomic.AddInt32(&b.queued, 1)
+    b.lock.Lock()
+    atomic.AddInt32(&b.queued, -1)
+}
+
+//
+// Method: frame
+//
+// Purpose: Writes a response frame header. The caller holds the lock.
+//
+func (b *binaryConn) frame(req *binaryRequest, status uint8, flags uint8, line uint64, length uint64) error {
+    var hdr [binary_header_size]byte
+    (&binaryResponse{binary_version, req.Opcode, status, flags, req.Id, line, length}).encode(hdr[:])
+    _, err := b.writer.Write(hdr[:])
+    return err
+}
+
+//
+// Method: flush
+//
+// Purpose: Sends the responses written so far, unless another response is waiting to be written
+//          (its writer flushes them instead). A connection that can't be written to is closed,
+//          which ends the wait for its next request.
+//
+func (b *binaryConn) flush(err error) {
+    if err == nil && atomic.LoadInt32(&b.queued) == 0 {
+        err = b.writer.Flush()
+    }
+    if err != nil {
+        b.zones.store.logger.Println("Client write error: ", err)
+        b.client.Close()
+    }
+}
+
+//
+// Method: reply
+//
+// Purpose: Writes a response of a single frame without text. Used for errors, COUNT and PING.
+//
+func (b *binaryConn) reply(req *binaryRequest, status uint8, line uint64) {
+    b.acquire()
+    defer b.lock.Unlock()
+    b.flush(b.frame(req, status, 0, line, 0))
+}
+
+//
+// Method: write_line
+//
+// Purpose: Writes one line of a textReply as a frame, given the header chunk already received from
+//          it. A line longer than a chunk, deferred by an inline request, is fetched again in full.
+//          A failed line gets a frame with the error's status and no text; an error is returned
+//          only if the connection can no longer be used. The caller holds the lock.
+//
+func (b *binaryConn) write_line(req *binaryRequest, line uint64, reply *textReply, hdr chunk, ok bool, flags uint8) error {
+    if ok && hdr.deferred {
+        reply.Abandon()
+        reply = b.zones.Get(line)
+        hdr, ok = <-reply.chunks
+    }
+    if !ok || hdr.err != nil {
+        reply.Abandon()
+        return b.frame(req, binary_status(hdr.err), flags, line, 0)
+    }
+    err := b.frame(req, status_ok, flags, line, hdr.size)
+    if err == nil {
+        err = write_data(b.writer, reply, hdr.size)
+    }
+    if err != nil {
+        reply.Abandon()
+    }
+    return err
+}
+
+//
+// Function: binary_status
+//
+// Purpose: Maps a retrieval error to its binary protocol status
+//
+func binary_status(err error) uint8 {
+    if err == errOutOfRange {
+        return status_out_of_range
+    }
+    return status_error
+}
+
+//
+// Method: serve
+//
+// Purpose: Serves one binary protocol request, and writes its response. A line no longer than a
+//          chunk is retrieved before the lock is taken, so short GETs complete in any order; longer
+//          responses are streamed under the lock. A streamer therefore never waits on a response
+//          that is itself waiting for the lock.
+//
+func (b *binaryConn) serve(req binaryRequest, lines []uint64) {
+    defer func() {
+        <-b.window
+        b.pending.Done()
+    }()
+
+    switch req.Opcode {
+    case op_get:
+        reply := b.zones.GetInline(req.Line)
+        hdr, ok := <-reply.chunks
+        b.acquire()
+        defer b.lock.Unlock()
+        b.flush(b.write_line(&req, req.Line, reply, hdr, ok, 0))
+
+    case op_range:
+        if req.Count < 1 {
+            b.reply(&req, status_malformed, 0)
+            return
+        }
+        b.acquire()
+        defer b.lock.Unlock()
+        b.flush(b.write_range(&req))
+
+    case op_mget:
+        b.acquire()
+        defer b.lock.Unlock()
+        b.flush(b.write_mget(&req, lines))
+
+    case op_count:
+        b.reply(&req, status_ok, b.zones.store.GetLines())
+
+    case op_ping:
+        b.reply(&req, status_ok, 0)
+
+    default:
+        b.reply(&req, status_malformed, 0)
+    }
+}
+
+//
+// Method: write_range
+//
+// Purpose: Writes count consecutive lines as one frame per line. The caller holds the lock.
+//
+func (b *binaryConn) write_range(req *binaryRequest) error {
+    reply := b.zones.GetRange(req.Line, req.Count)
+    for i := uint64(0); i < req.Count; i++ {
+        hdr, ok := <-reply.chunks
+        if !ok || hdr.err != nil {
+            // Either the range is invalid, or a line could not be read; the response ends here
+            reply.Abandon()
+            return b.frame(req, binary_status(hdr.err), 0, req.Line + i, 0)
+        }
+
+        var flags uint8
+        if i < req.Count - 1 {
+            flags = binary_more
+        }
+        if err := b.frame(req, status_ok, flags, req.Line + i, hdr.size); err != nil {
+            reply.Abandon()
+            return err
+        }
+        if err := write_data(b.writer, reply, hdr.size); err != nil {
+            reply.Abandon()
+            return err
+        }
+    }
+    return nil
+}
+
+//
+// Method: write_mget
+//
+// Purpose: Writes a frame per requested line, in request order, as write_mget does for the text
+//          protocol. The caller holds the lock.
+//
+func (b *binaryConn) write_mget(req *binaryRequest, lines []uint64) error {
+    if len(lines) == 0 {
+        return b.frame(req, status_ok, 0, 0, 0)
+    }
+
+    return write_window(b.zones, lines, func(i int, reply *textReply, hdr chunk, ok bool) error {
+        var flags uint8
+        if i < len(lines) - 1 {
+            flags = binary_more
+        }
+        return b.write_line(req, lines[i], reply, hdr, ok, flags)
+    })
+}
+
+//
+// GoRoutine: binary_handler
+//
+// Purpose: Reads binary protocol requests, and dispatches each to its own GoRoutine, up to
+//          binary_window at a time
+//
+func binary_handler(client net.Conn, idle time.Duration, state *serverState, admin bool) {
+    state.Track(client)
+    cfg := state.Acquire()  // This connection is served from the same snapshot until it closes
+
+    b := &binaryConn{client, bufio.NewWriter(&stallConn{client, state.opts.WriteTimeout}), new(sync.Mutex), cfg.zones, new(sync.WaitGroup),
+        make(chan struct{}, binary_window), 0}
+
+    // client handler closure
+    defer func() {
+        b.pending.Wait()    // Finish the requests in progress
+        state.opts.Logger.Printf("Closing socket to %s\n", client.RemoteAddr().String())
+        cfg.Release()
+        state.Untrack(client)
+        client.Close()
+        state.clients.Release(admin)
+        state.Done()
+    }()
+
+    reader := bufio.NewReader(client)
+    var hdr [binary_header_size]byte
+    for {
+        state.SetIdleDeadline(client, idle)
+
+        var req binaryRequest
+        if _, err := io.ReadFull(reader, hdr[:]); err != nil {
+            if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+                if state.IsShutdown() {
+                    state.opts.Logger.Println("Client received shutdown signal")
+                } else {
+                    state.opts.Logger.Println("Client idle timeout")
+                }
+            } else if err != io.EOF {
+                state.opts.Logger.Println("Client read error: ", err)
+            }
+            return
+        }
+        req.decode(hdr[:])
+
+        // A request that can't be parsed leaves the rest of the stream unparseable
+        if req.Version != binary_version || (req.Opcode == op_mget && req.Count > binary_max_mget) {
+            b.reply(&req, status_malformed, 0)
+            return
+        }
+
+        var lines []uint64
+        if req.Opcode == op_mget {
+            lines = make([]uint64, req.Count)
+            if err := binary.Read(reader, binary.LittleEndian, lines); err != nil {
+                state.opts.Logger.Println("Client read error: ", err)
+                return
+            }
+        }
+
+        if req.Opcode == op_quit {
+            return
+        }
+        if state.IsShutdown() {
+            b.reply(&req, status_shutdown, 0)
+            continue
+        }
+
+        b.window <- struct{}{}
+        b.pending.Add(1)
+        go b.serve(req, lines)
+    }
+}
@@ -0,0 +1,84 @@
+package lineserver
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "strings"
+    "testing"
+)
+
+//
+// Function: binary_request
+//
+// Purpose: Encodes a binary protocol request, followed by its MGET line numbers, if any
+//
+func binary_request(op uint8, id uint32, line uint64, count uint64, lines ...uint64) []byte {
+    b := make([]byte, binary_header_size + 8 * len(lines))
+    b[0] = binary_version
+    b[1] = op
+    binary.LittleEndian.PutUint32(b[4:8], id)
+    binary.LittleEndian.PutUint64(b[8:16], line)
+    binary.LittleEndian.PutUint64(b[16:24], count)
+    for i, l := range lines {
+        binary.LittleEndian.PutUint64(b[binary_header_size + 8 * i:], l)
+    }
+    return b
+}
+
+func TestBinaryPipelining(t *testing.T) {
+    client, _ := start_handler(t, "one\ntwo\nthree\n" + long_line + "\nfive\n", binary_handler)
+
+    var requests []byte
+    requests = append(requests, binary_request(op_get, 1, 4, 0)...)
+    requests = append(requests, binary_request(op_get, 2, 1, 0)...)
+    requests = append(requests, binary_request(op_get, 3, 9, 0)...)
+    requests = append(requests, binary_request(op_range, 4, 2, 2)...)
+    requests = append(requests, binary_request(op_mget, 5, 0, 3, 5, 0, 1)...)
+    requests = append(requests, binary_request(op_count, 6, 0, 0)...)
+    requests = append(requests, binary_request(op_range, 7, 1, 0)...)
+    requests = append(requests, binary_request(99, 8, 0, 0)...)
+    requests = append(requests, binary_request(op_quit, 9, 0, 0)...)
+    go client.Write(requests)
+
+    // Responses may arrive in any order, but the frames of one response are contiguous
+    want := map[uint32]string{
+        1: fmt.Sprintf("0 4 %d;", len(strings.TrimSpace(long_line))),
+        2: "0 1 one;",
+        3: "1 9 ;",
+        4: "0 2 two|0 3 three;",
+        5: "0 5 five|1 0 |0 1 one;",
+        6: "0 5 ;",
+        7: "2 0 ;",
+        8: "2 0 ;",
+    }
+    have := make(map[uint32]string)
+    var hdr [binary_header_size]byte
+    for {
+        if _, err := io.ReadFull(client, hdr[:]); err != nil {
+            break
+        }
+        status, flags := hdr[2], hdr[3]
+        id := binary.LittleEndian.Uint32(hdr[4:8])
+        line := binary.LittleEndian.Uint64(hdr[8:16])
+        text := make([]byte, binary.LittleEndian.Uint64(hdr[16:24]))
+        if _, err := io.ReadFull(client, text); err != nil {
+            t.Fatal(err)
+        }
+        if id == 1 && len(text) > 0 {
+            text = []byte(fmt.Sprint(len(text)))
+        }
+        have[id] += fmt.Sprintf("%d %d %s", status, line, text)
+        if flags & binary_more != 0 {
+            have[id] += "|"
+        } else {
+            have[id] += ";"
+        }
+    }
+
+    for id, w := range want {
+        if have[id] != w {
+            t.Errorf("request %d: %q, want %q", id, have[id], w)
+        }
+    }
+}
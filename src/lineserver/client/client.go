@@ -0,0 +1,646 @@
+//
+//  Package client is a Go client for the line server's text protocol. A Client keeps a pool of
+//  connections to one server, and is safe for concurrent use:
+//
+//      c := client.New("localhost:10497", client.Options{MaxConns: 8})
+//      defer c.Close()
+//      text, err := c.Get(ctx, 42)
+//
+//  Connections negotiate length framing, so lines are returned exactly as the server sends them,
+//  embedded CRs included. A pooled connection that the server has closed (e.g. after its idle
+//  timeout) is replaced, and the request retried, transparently.
+//
+package client
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strconv"
+    "sync"
+    "syscall"
+    "time"
+)
+
+var (
+    ErrOutOfRange   = errors.New("lineserver: line out of range")
+    ErrMalformed    = errors.New("lineserver: malformed request")
+    ErrShuttingDown = errors.New("lineserver: server shutting down")
+    ErrBusy         = errors.New("lineserver: server busy")
+    ErrProtocol     = errors.New("lineserver: malformed response")
+    ErrClosed       = errors.New("lineserver: client closed")
+)
+
+const (
+    default_max_idle = 2
+    mget_batch       = 512  // Most lines requested by one MGET command
+)
+
+//
+//  Options object - how a Client connects to its server. A zero field takes the default given in
+//  its comment.
+//
+type Options struct {
+    MaxConns    int             // Most connections open at once; 0 is unlimited
+    MaxIdle     int             // Idle connections kept for reuse; default 2
+    DialTimeout time.Duration   // How long a connection attempt may take; 0 leaves it to the context
+}
+
+//
+//  Result object - the outcome of one command of a pipeline, or of one line of a batch
+//
+type Result struct {
+    Lines [][]byte  // The lines returned: one for a Get, and each line of a Range
+    Err   error     // ErrOutOfRange or ErrMalformed if the server could not serve the command
+}
+
+//
+//  Client object and methods - a pool of connections to one line server
+//
+type Client struct {
+    addr   string
+    opts   Options
+    dialer net.Dialer
+    slots  chan struct{}    // Holds a token for each open connection, when MaxConns is set
+    idle   chan *connection
+
+    lock   sync.Mutex
+    closed bool
+}
+
+//
+// Function: New
+//
+// Purpose: Returns a Client for the line server at addr. No connection is made until the first
+//          request.
+//
+func New(addr string, opts Options) *Client {
+    if opts.MaxIdle <= 0 {
+        opts.MaxIdle = default_max_idle
+    }
+    c := &Client{addr: addr, opts: opts, idle: make(chan *connection, opts.MaxIdle)}
+    c.dialer.Timeout = opts.DialTimeout
+    if opts.MaxConns > 0 {
+        c.slots = make(chan struct{}, opts.MaxConns)
+    }
+    return c
+}
+
+//
+// Method: Close
+//
+// Purpose: Closes the idle connections. Requests in progress finish, and their connections are
+//          then closed; later requests fail with ErrClosed.
+//
+func (c *Client) Close() error {
+    c.lock.Lock()
+    c.closed = true
+    c.lock.Unlock()
+
+    for {
+        select {
+        case cn := <-c.idle:
+            cn.conn.Close()
+        default:
+            return nil
+        }
+    }
+}
+
+//
+// Method: Get
+//
+// Purpose: Returns the text of one line. Returns ErrOutOfRange if the server has no such line.
+//
+func (c *Client) Get(ctx context.Context, line uint64) ([]byte, error) {
+    results, err := c.do(ctx, []command{get_command(line)})
+    if err != nil {
+        return nil, err
+    }
+    if results[0].Err != nil {
+        return nil, results[0].Err
+    }
+    return results[0].Lines[0], nil
+}
+
+//
+// Method: Range
+//
+// Purpose: Returns lines first to last, inclusive. Returns ErrOutOfRange if any of them is past
+//          the end of the file, and ErrMalformed if the range is empty or starts at line 0.
+//
+func (c *Client) Range(ctx context.Context, first uint64, last uint64) ([][]byte, error) {
+    cmd := range_command(first, last)
+    if cmd.err != nil {
+        return nil, cmd.err
+    }
+    results, err := c.do(ctx, []command{cmd})
+    if err != nil {
+        return nil, err
+    }
+    return results[0].Lines, results[0].Err
+}
+
+//
+// Method: GetMany
+//
+// Purpose: Returns any number of lines, in request order, one Result per line. Lines the server
+//          does not have are returned with ErrOutOfRange, without failing the batch. The lines are
+//          requested in MGET batches, pipelined on a single connection.
+//
+func (c *Client) GetMany(ctx context.Context, lines []uint64) ([]Result, error) {
+    var cmds []command
+    for base := 0; base < len(lines); base += mget_batch {
+        batch := lines[base:]
+        if len(batch) > mget_batch {
+            batch = batch[:mget_batch]
+        }
+        cmds = append(cmds, mget_command(batch))
+    }
+    if cmds == nil {
+        return nil, nil
+    }
+    return c.do(ctx, cmds)
+}
+
+//
+// Method: Count
+//
+// Purpose: Returns the number of lines the server is serving
+//
+func (c *Client) Count(ctx context.Context) (uint64, error) {
+    results, err := c.do(ctx, []command{{text: "COUNT\r\n", reply: reply_count}})
+    if err != nil {
+        return 0, err
+    }
+    if results[0].Err != nil {
+        return 0, results[0].Err
+    }
+    count, err := strconv.ParseUint(string(results[0].Lines[0]), 10, 64)
+    if err != nil {
+        return 0, ErrProtocol
+    }
+    return count, nil
+}
+
+//
+//  Pipeline object and methods - commands queued to be sent together, without waiting for each
+//  other's responses
+//
+type Pipeline struct {
+    client *Client
+    cmds   []command
+}
+
+//
+// Method: Pipeline
+//
+// Purpose: Returns an empty pipeline on the client
+//
+func (c *Client) Pipeline() *Pipeline {
+    return &Pipeline{client: c}
+}
+
+//
+// Method: Get
+//
+// Purpose: Queues a request for one line
+//
+func (p *Pipeline) Get(line uint64) {
+    p.cmds = append(p.cmds, get_command(line))
+}
+
+//
+// Method: Range
+//
+// Purpose: Queues a request for lines first to last, inclusive
+//
+func (p *Pipeline) Range(first uint64, last uint64) {
+    p.cmds = append(p.cmds, range_command(first, last))
+}
+
+//
+// Method: Exec
+//
+// Purpose: Sends the queued commands over one connection, and returns a Result per command, in
+//          the order they were queued. The error is set only if the exchange itself failed. The
+//          pipeline is then empty, and may be reused.
+//
+func (p *Pipeline) Exec(ctx context.Context) ([]Result, error) {
+    cmds := p.cmds
+    p.cmds = nil
+    if len(cmds) == 0 {
+        return nil, nil
+    }
+    return p.client.do(ctx, cmds)
+}
+
+//
+// Method: do
+//
+// Purpose: Runs commands on a pooled connection. If a reused connection turns out to have been
+//          closed by the server before it answered, the commands are retried once on a new
+//          connection. A server that closes a new connection without answering, or that stops
+//          accepting connections when reconnected to, is shutting down.
+//
+func (c *Client) do(ctx context.Context, cmds []command) ([]Result, error) {
+    for retry := false; ; retry = true {
+        cn, err := c.acquire(ctx, retry)
+        if err != nil {
+            if retry && is_refused(err) {
+                err = ErrShuttingDown
+            }
+            return nil, err
+        }
+
+        results, err := cn.exec(ctx, cmds)
+        c.release(cn, err == nil)
+        if err == err_closed_by_server {
+            if cn.reused && !retry {
+                continue
+            }
+            err = ErrShuttingDown
+        }
+        return results, err
+    }
+}
+
+//
+// Method: acquire
+//
+// Purpose: Returns an idle connection, unless a fresh one is required, or dials a new one once the
+//          pool has room for it
+//
+func (c *Client) acquire(ctx context.Context, fresh bool) (*connection, error) {
+    c.lock.Lock()
+    closed := c.closed
+    c.lock.Unlock()
+    if closed {
+        return nil, ErrClosed
+    }
+
+    if c.slots != nil {
+        select {
+        case c.slots <- struct{}{}:
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+
+    if !fresh {
+        select {
+        case cn := <-c.idle:
+            cn.reused = true
+            return cn, nil
+        default:
+        }
+    }
+
+    cn, err := c.dial(ctx)
+    if err != nil && c.slots != nil {
+        <-c.slots
+    }
+    return cn, err
+}
+
+//
+// Method: release
+//
+// Purpose: Returns a connection to the idle pool, or closes it if it is no longer usable, or if
+//          the pool is full
+//
+func (c *Client) release(cn *connection, healthy bool) {
+    // Pooled under the lock, so that Close can't miss it
+    c.lock.Lock()
+    if healthy && !c.closed {
+        select {
+        case c.idle <- cn:
+            cn = nil
+        default:
+        }
+    }
+    c.lock.Unlock()
+
+    if cn != nil {
+        cn.conn.Close()
+    }
+    if c.slots != nil {
+        <-c.slots
+    }
+}
+
+//
+// Method: dial
+//
+// Purpose: Connects to the server, and switches the connection to length framing. The server may
+//          queue a new connection until it has a free client slot, or turn it away as BUSY.
+//
+func (c *Client) dial(ctx context.Context) (*connection, error) {
+    conn, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+    if err != nil {
+        return nil, err
+    }
+    cn := &connection{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+    if _, err := cn.exec(ctx, []command{{text: "FRAMING length\r\n", reply: reply_status}}); err != nil {
+        conn.Close()
+        if err == err_closed_by_server {
+            err = ErrShuttingDown
+        }
+        return nil, err
+    }
+    return cn, nil
+}
+
+//
+//  Command object - one request, and the shape of its response
+//
+type command struct {
+    text  string
+    reply int
+    count int     // Lines requested by an MGET
+    err   error   // Set if the request was rejected before it was sent
+}
+
+const (
+    reply_line   = iota // OK <len>, then the line; or ERR
+    reply_lines         // OK <count>, then <len> and the line, for each line; or ERR
+    reply_mget          // OK <count>, then OK <len> and the line, or ERR, for each line
+    reply_count         // OK, then the count
+    reply_status        // OK
+    reply_none          // Not sent
+)
+
+func get_command(line uint64) command {
+    return command{text: fmt.Sprintf("GET %d\r\n", line), reply: reply_line}
+}
+
+func range_command(first uint64, last uint64) command {
+    if first < 1 || last < first {
+        return command{reply: reply_none, err: ErrMalformed}
+    }
+    return command{text: fmt.Sprintf("GET %d-%d\r\n", first, last), reply: reply_lines}
+}
+
+func mget_command(lines []uint64) command {
+    b := []byte("MGET")
+    for _, line := range lines {
+        b = append(b, ' ')
+        b = strconv.AppendUint(b, line, 10)
+    }
+    return command{text: string(append(b, "\r\n"...)), reply: reply_mget, count: len(lines)}
+}
+
+// The server closed the connection before it began to answer
+var err_closed_by_server = errors.New("connection closed by server")
+
+//
+//  connection object and methods - one connection of the pool
+//
+type connection struct {
+    conn   net.Conn
+    reader *bufio.Reader
+    writer *bufio.Writer
+    reused bool     // Taken from the idle pool, so it may have been closed by the server meanwhile
+}
+
+//
+// Method: exec
+//
+// Purpose: Writes commands to the connection while reading their responses, so that a long
+//          pipeline can't fill the socket buffers in both directions. Returns the Results, one per
+//          line of an MGET and one per other command. The context's deadline, or its cancellation,
+//          interrupts the exchange, and the connection must then be discarded.
+//
+func (cn *connection) exec(ctx context.Context, cmds []command) ([]Result, error) {
+    deadline, has_deadline := ctx.Deadline()
+    cn.conn.SetDeadline(deadline)
+
+    // Cancelling the context cuts short any read or write in progress
+    stop := make(chan struct{})
+    watcher := make(chan struct{})
+    go func() {
+        defer close(watcher)
+        select {
+        case <-ctx.Done():
+            cn.conn.SetDeadline(time.Now())
+        case <-stop:
+        }
+    }()
+    defer func() {
+        close(stop)
+        <-watcher
+    }()
+
+    written := make(chan error, 1)
+    go func() {
+        for _, cmd := range cmds {
+            if _, err := cn.writer.WriteString(cmd.text); err != nil {
+                written <- err
+                return
+            }
+        }
+        written <- cn.writer.Flush()
+    }()
+
+    var results []Result
+    var err error
+    answered := false
+    for _, cmd := range cmds {
+        if results, err = cn.read_reply(cmd, results); err != nil {
+            if !answered && is_closed(err) {
+                err = err_closed_by_server
+            }
+            break
+        }
+        answered = answered || cmd.reply != reply_none
+    }
+    if err != nil {
+        cn.conn.SetDeadline(time.Now())     // Unblocks the writer
+    }
+    if werr := <-written; err == nil {
+        err = werr
+    }
+
+    if err != nil && ctx.Err() != nil {
+        err = ctx.Err()
+    } else if ne, ok := err.(net.Error); ok && ne.Timeout() && has_deadline && !time.Now().Before(deadline) {
+        err = context.DeadlineExceeded     // The socket's deadline can pass just before the context's
+    }
+    return results, err
+}
+
+//
+// Method: read_reply
+//
+// Purpose: Reads the response to one command, appending its Results
+//
+func (cn *connection) read_reply(cmd command, results []Result) ([]Result, error) {
+    if cmd.reply == reply_none {
+        return append(results, Result{Err: cmd.err}), nil
+    }
+
+    status, arg, err := cn.read_status()
+    if err != nil {
+        return results, err
+    }
+    switch status {
+    case "BUSY":
+        return results, ErrBusy
+    case "ERR":
+        if cmd.reply == reply_mget {
+            return results, ErrMalformed    // The batch as a whole was rejected
+        }
+        if cmd.reply == reply_status || cmd.reply == reply_count {
+            return append(results, Result{Err: ErrMalformed}), nil
+        }
+        return append(results, Result{Err: ErrOutOfRange}), nil
+    case "OK":
+    default:
+        return results, ErrProtocol
+    }
+
+    switch cmd.reply {
+    case reply_status:
+        return append(results, Result{}), nil
+    case reply_line:
+        text, err := cn.read_text(arg)
+        return append(results, Result{Lines: [][]byte{text}}), err
+    case reply_count:
+        text, err := cn.read_header()
+        return append(results, Result{Lines: [][]byte{[]byte(text)}}), err
+    }
+
+    count, err := strconv.Atoi(arg)
+    if err != nil || count < 0 {
+        return results, ErrProtocol
+    }
+    if cmd.reply == reply_mget && count != cmd.count {
+        return results, ErrProtocol
+    }
+
+    var lines [][]byte
+    for i := 0; i < count; i++ {
+        if cmd.reply == reply_mget {
+            // Each line of an MGET has its own OK or ERR response
+            if results, err = cn.read_reply(command{reply: reply_line}, results); err != nil {
+                return results, err
+            }
+            continue
+        }
+        size, err := cn.read_header()
+        if err != nil {
+            return results, err
+        }
+        text, err := cn.read_text(size)
+        if err != nil {
+            return results, err
+        }
+        lines = append(lines, text)
+    }
+    if cmd.reply == reply_lines {
+        results = append(results, Result{Lines: lines})
+    }
+    return results, nil
+}
+
+//
+// Method: read_status
+//
+// Purpose: Reads a response header, e.g. "OK 12", and splits it into its status and argument
+//
+func (cn *connection) read_status() (string, string, error) {
+    header, err := cn.read_header()
+    if err != nil {
+        return "", "", err
+    }
+    for i := 0; i < len(header); i++ {
+        if header[i] == ' ' {
+            return header[:i], header[i + 1:], nil
+        }
+    }
+    return header, "", nil
+}
+
+//
+// Method: read_header
+//
+// Purpose: Reads one CR-LF terminated header line, without its CR-LF
+//
+func (cn *connection) read_header() (string, error) {
+    line, err := cn.reader.ReadSlice('\n')
+    if err == bufio.ErrBufferFull {
+        return "", ErrProtocol
+    }
+    if err != nil {
+        if err == io.EOF && len(line) > 0 {
+            err = io.ErrUnexpectedEOF
+        }
+        return "", err
+    }
+    if len(line) < 2 || line[len(line) - 2] != '\r' {
+        return "", ErrProtocol
+    }
+    return string(line[:len(line) - 2]), nil
+}
+
+//
+// Method: read_text
+//
+// Purpose: Reads a line of the given length, and its terminating CR-LF
+//
+func (cn *connection) read_text(length string) ([]byte, error) {
+    size, err := strconv.ParseUint(length, 10, 63)
+    if err != nil {
+        return nil, ErrProtocol
+    }
+    text := make([]byte, size + 2)
+    if _, err := io.ReadFull(cn.reader, text); err != nil {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return nil, err
+    }
+    if text[size] != '\r' || text[size + 1] != '\n' {
+        return nil, ErrProtocol
+    }
+    return text[:size:size], nil
+}
+
+//
+// Function: is_closed
+//
+// Purpose: Reports whether a read failed because the server closed the connection
+//
+func is_closed(err error) bool {
+    errno := syscall_errno(err)
+    return err == io.EOF || errno == syscall.ECONNRESET || errno == syscall.EPIPE
+}
+
+//
+// Function: is_refused
+//
+// Purpose: Reports whether a dial failed because nothing is listening at the server's address
+//
+func is_refused(err error) bool {
+    return syscall_errno(err) == syscall.ECONNREFUSED
+}
+
+//
+// Function: syscall_errno
+//
+// Purpose: Returns the system call error underlying a network error, or 0 if there is none
+//
+func syscall_errno(err error) syscall.Errno {
+    if op, ok := err.(*net.OpError); ok {
+        err = op.Err
+    }
+    if sc, ok := err.(*os.SyscallError); ok {
+        err = sc.Err
+    }
+    errno, _ := err.(syscall.Errno)
+    return errno
+}
@@ -0,0 +1,203 @@
+package client
+
+import (
+    "bytes"
+    "context"
+    "io/ioutil"
+    "net"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "lineserver"
+)
+
+//
+// Function: start_server
+//
+// Purpose: Serves a generated source file from an in-process server on an ephemeral port, and
+//          returns the server and its address. The server is shut down when the test ends.
+//
+func start_server(t *testing.T, content string, opts lineserver.Options) (*lineserver.Server, string) {
+    source_file := filepath.Join(t.TempDir(), "source.txt")
+    if err := ioutil.WriteFile(source_file, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    srv, err := lineserver.NewServer(source_file, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go srv.Serve(l)
+    t.Cleanup(func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        defer cancel()
+        srv.Shutdown(ctx)
+    })
+    return srv, l.Addr().String()
+}
+
+func TestClientRequests(t *testing.T) {
+    long := strings.Repeat("long\r", 40000)
+    _, addr := start_server(t, "one\n  two  \n" + long + "x\n\nfive\n", lineserver.Options{})
+    c := New(addr, Options{})
+    defer c.Close()
+    ctx := context.Background()
+
+    want := []string{"one", "two", long + "x", "", "five"}
+    for i, text := range want {
+        got, err := c.Get(ctx, uint64(i + 1))
+        if err != nil || string(got) != text {
+            t.Errorf("Get(%d) = %.20q %v, want %.20q", i + 1, got, err, text)
+        }
+    }
+    for _, line := range []uint64{0, 6, 1 << 40} {
+        if _, err := c.Get(ctx, line); err != ErrOutOfRange {
+            t.Errorf("Get(%d) returned %v, want %v", line, err, ErrOutOfRange)
+        }
+    }
+
+    lines, err := c.Range(ctx, 2, 5)
+    if err != nil || len(lines) != 4 || string(lines[1]) != long + "x" || string(lines[3]) != "five" {
+        t.Errorf("Range(2, 5) = %d lines %v", len(lines), err)
+    }
+    if _, err := c.Range(ctx, 4, 6); err != ErrOutOfRange {
+        t.Errorf("Range(4, 6) returned %v, want %v", err, ErrOutOfRange)
+    }
+    if _, err := c.Range(ctx, 3, 2); err != ErrMalformed {
+        t.Errorf("Range(3, 2) returned %v, want %v", err, ErrMalformed)
+    }
+
+    if n, err := c.Count(ctx); n != 5 || err != nil {
+        t.Errorf("Count() = %d %v, want 5", n, err)
+    }
+}
+
+func TestClientBatches(t *testing.T) {
+    var source bytes.Buffer
+    for i := 1; i <= 2000; i++ {
+        source.WriteString(strings.Repeat("x", i % 37) + "\n")
+    }
+    _, addr := start_server(t, source.String(), lineserver.Options{})
+    c := New(addr, Options{})
+    defer c.Close()
+    ctx := context.Background()
+
+    // More lines than fit one MGET, in no particular order, some out of range
+    var lines []uint64
+    for i := uint64(0); i < 1500; i++ {
+        lines = append(lines, (i * 7919) % 2100 + 1)
+    }
+    results, err := c.GetMany(ctx, lines)
+    if err != nil || len(results) != len(lines) {
+        t.Fatalf("GetMany returned %d results %v, want %d", len(results), err, len(lines))
+    }
+    for i, line := range lines {
+        if line > 2000 {
+            if results[i].Err != ErrOutOfRange {
+                t.Errorf("line %d: %v, want %v", line, results[i].Err, ErrOutOfRange)
+            }
+        } else if results[i].Err != nil || len(results[i].Lines[0]) != int(line % 37) {
+            t.Errorf("line %d: %d bytes %v, want %d", line, len(results[i].Lines), results[i].Err, line % 37)
+        }
+    }
+
+    p := c.Pipeline()
+    p.Get(36)
+    p.Range(1, 3)
+    p.Get(2001)
+    p.Range(0, 1)
+    p.Get(1)
+    results, err = p.Exec(ctx)
+    if err != nil || len(results) != 5 {
+        t.Fatalf("Exec returned %d results %v, want 5", len(results), err)
+    }
+    if string(results[0].Lines[0]) != strings.Repeat("x", 36) || len(results[1].Lines) != 3 ||
+        results[2].Err != ErrOutOfRange || results[3].Err != ErrMalformed || string(results[4].Lines[0]) != "x" {
+        t.Errorf("Exec returned %q", results)
+    }
+    if results, err := p.Exec(ctx); results != nil || err != nil {
+        t.Errorf("Exec of an empty pipeline returned %q %v", results, err)
+    }
+}
+
+func TestClientPool(t *testing.T) {
+    srv, addr := start_server(t, "a\nb\nc\n", lineserver.Options{IdleTimeout: 200 * time.Millisecond})
+    c := New(addr, Options{MaxConns: 3, MaxIdle: 3})
+    defer c.Close()
+    ctx := context.Background()
+
+    var wg sync.WaitGroup
+    for g := 0; g < 10; g++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < 50; i++ {
+                if text, err := c.Get(ctx, 2); err != nil || string(text) != "b" {
+                    t.Errorf("Get(2) = %q %v", text, err)
+                    return
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    if _, peak, total := srv.Clients(); peak > 3 || total > 3 {
+        t.Errorf("peak %d, total %d connections, want at most 3", peak, total)
+    }
+
+    // The server closes the idle connections; the client reconnects
+    time.Sleep(500 * time.Millisecond)
+    if text, err := c.Get(ctx, 3); err != nil || string(text) != "c" {
+        t.Errorf("Get(3) after idle timeout = %q %v", text, err)
+    }
+
+    c.Close()
+    if _, err := c.Get(ctx, 1); err != ErrClosed {
+        t.Errorf("Get after Close returned %v, want %v", err, ErrClosed)
+    }
+}
+
+func TestClientErrors(t *testing.T) {
+    // With its only client slot taken, the server queues new connections, or turns them away
+    for _, policy := range []string{lineserver.AdmitQueue, lineserver.AdmitReject} {
+        t.Run(policy, func(t *testing.T) {
+            _, addr := start_server(t, "a\n", lineserver.Options{MaxClients: 1, AdmitPolicy: policy})
+            holder, err := net.Dial("tcp", addr)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer holder.Close()
+            holder.Write([]byte("COUNT\r\n"))
+            holder.Read(make([]byte, 16))   // Admitted
+
+            c := New(addr, Options{})
+            defer c.Close()
+            ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+            defer cancel()
+            want := ErrBusy
+            if policy == lineserver.AdmitQueue {
+                want = context.DeadlineExceeded
+            }
+            if _, err := c.Get(ctx, 1); err != want {
+                t.Errorf("Get returned %v, want %v", err, want)
+            }
+        })
+    }
+
+    srv, addr := start_server(t, "a\n", lineserver.Options{})
+    c := New(addr, Options{})
+    defer c.Close()
+    ctx := context.Background()
+    if _, err := c.Get(ctx, 1); err != nil {
+        t.Fatal(err)
+    }
+    srv.Shutdown(ctx)
+    if _, err := c.Get(ctx, 1); err != ErrShuttingDown {
+        t.Errorf("Get after shutdown returned %v, want %v", err, ErrShuttingDown)
+    }
+}
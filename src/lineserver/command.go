@@ -0,0 +1,47 @@
+package lineserver
+
+import (
+    "regexp"
+    "strings"
+)
+
+//
+//  Command syntax, by verb. Each pattern matches the complete command line, including the
+//  terminating CR-LF, and captures the command's arguments.
+//
+var command_syntax = map[string]*regexp.Regexp{
+    "GET":      regexp.MustCompile(`^GET (\d+)(?:-(\d+))?\r\n$`),
+    "GETRANGE": regexp.MustCompile(`^GETRANGE (\d+) (\d+)\r\n$`),
+    "MGET":     regexp.MustCompile(`^MGET((?: \d+)+)\r\n$`),
+    "COUNT":    regexp.MustCompile(`^COUNT\r\n$`),
+    "STAT":     regexp.MustCompile(`^STAT\r\n$`),
+    "INFO":     regexp.MustCompile(`^INFO\r\n$`),
+    "TAIL":     regexp.MustCompile(`^TAIL (\d+)\r\n$`),
+    "FRAMING":  regexp.MustCompile(`^FRAMING (line|length)\r\n$`),
+    "RELOAD":   regexp.MustCompile(`^RELOAD(?: (\S+))?\r\n$`),
+    "QUIT":     regexp.MustCompile(`^QUIT\r\n$`),
+    "SHUTDOWN": regexp.MustCompile(`^SHUTDOWN(?: (\S+))?\r\n$`),
+}
+
+//
+// Function: parse_command
+//
+// Purpose: Validates a client command. Returns the command's verb and arguments, or an empty verb
+//          if the command is not valid. Optional arguments that are absent are returned as "".
+//
+func parse_command(msg string) (string, []string) {
+    verb := msg
+    if i := strings.IndexAny(msg, " \r\n"); i >= 0 {
+        verb = msg[:i]
+    }
+
+    syntax, ok := command_syntax[verb]
+    if !ok {
+        return "", nil
+    }
+    s := syntax.FindStringSubmatch(msg)
+    if s == nil {
+        return "", nil
+    }
+    return verb, s[1:]
+}
@@ -0,0 +1,411 @@
+package lineserver
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io/ioutil"
+    "math/rand"
+    "net"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+//
+//  Conformance suite. Each test starts a Server in-process, on an ephemeral port, against a
+//  generated source file, and talks to it over TCP as any client would. Responses are compared
+//  byte for byte with lines split from the source file by the test itself (as test-it does with
+//  sed), so no external tools are needed.
+//
+
+//
+// Function: start_test_server
+//
+// Purpose: Serves content from an in-process server, and returns the server and its address. The
+//          server is shut down when the test ends, if the test has not shut it down itself.
+//
+func start_test_server(t *testing.T, content string, opts Options) (*Server, string, <-chan error) {
+    srv, err := NewServer(write_source(t, content), opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    served := make(chan error, 1)
+    go func() {
+        served <- srv.Serve(l)
+    }()
+    t.Cleanup(func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        defer cancel()
+        srv.Shutdown(ctx)
+    })
+    return srv, l.Addr().String(), served
+}
+
+//
+// Function: exchange
+//
+// Purpose: Sends requests on a new connection and half-closes it, as nc does at the end of its
+//          input, then returns everything the server sent before it closed the connection
+//
+func exchange(t *testing.T, addr string, requests string) []byte {
+    t.Helper()
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+    if _, err := conn.Write([]byte(requests)); err != nil {
+        t.Fatal(err)
+    }
+    conn.(*net.TCPConn).CloseWrite()
+    reply, err := ioutil.ReadAll(conn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return reply
+}
+
+//
+// Function: source_lines
+//
+// Purpose: Splits a source file into its lines as the server should serve them: each LF ends a
+//          line, and a final line without one is a line too. Lines are trimmed per the trim mode.
+//
+func source_lines(content string, trim string) []string {
+    lines := strings.SplitAfter(content, "\n")
+    if lines[len(lines) - 1] == "" {
+        lines = lines[:len(lines) - 1]
+    }
+    for i, line := range lines {
+        if trim == TrimExact {
+            line = strings.TrimSuffix(line, "\n")
+            lines[i] = strings.TrimSuffix(line, "\r")
+        } else {
+            lines[i] = strings.TrimSpace(line)
+        }
+    }
+    return lines
+}
+
+//
+// Function: generate_source
+//
+// Purpose: Generates a source file of lines of random length and content: empty lines, lines of
+//          only whitespace, leading and trailing whitespace (ASCII and Unicode), CRLF endings,
+//          embedded CRs, NULs and bytes that aren't UTF-8, and one line longer than many chunks.
+//          The last line has no newline.
+//
+func generate_source(seed int64, lines int) string {
+    rng := rand.New(rand.NewSource(seed))
+    edges := []string{" ", "\t", "\r", "\v", "\f", "\u00a0", "\u0085", "\u3000", "\u2028"}
+    var b bytes.Buffer
+    for i := 1; i <= lines; i++ {
+        if i == lines / 2 {
+            b.WriteString(strings.Repeat("long line ", 30000))
+        }
+        if rng.Intn(4) == 0 {
+            b.WriteString(edges[rng.Intn(len(edges))])
+        }
+        for n := rng.Intn(120); n > 0; n-- {
+            switch rng.Intn(20) {
+            case 0:
+                b.WriteByte('\r')
+            case 1:
+                b.WriteByte(0)
+            case 2:
+                b.WriteByte(byte(0x80 + rng.Intn(0x80)))
+            case 3:
+                b.WriteByte(' ')
+            default:
+                b.WriteByte(byte('!' + rng.Intn(94)))
+            }
+        }
+        if rng.Intn(4) == 0 {
+            b.WriteString(edges[rng.Intn(len(edges))])
+        }
+        if i < lines {
+            if rng.Intn(3) == 0 {
+                b.WriteByte('\r')
+            }
+            b.WriteByte('\n')
+        }
+    }
+    return b.String()
+}
+
+func TestConformanceGetAllLines(t *testing.T) {
+    content := generate_source(1, 250)
+    for _, trim := range []string{TrimSpace, TrimExact} {
+        t.Run(trim, func(t *testing.T) {
+            _, addr, _ := start_test_server(t, content, Options{TrimMode: trim, ChunkSize: 4096})
+            for i, line := range source_lines(content, trim) {
+                // One connection per line, as test-it makes
+                want := "OK\r\n" + line + "\r\n"
+                if reply := exchange(t, addr, fmt.Sprintf("GET %d\r\n", i + 1)); string(reply) != want {
+                    t.Fatalf("line %d: got %d bytes %.40q, want %d bytes %.40q", i + 1, len(reply), reply, len(want), want)
+                }
+            }
+        })
+    }
+}
+
+func TestConformanceMultipleRequests(t *testing.T) {
+    content := generate_source(2, 100)
+    _, addr, _ := start_test_server(t, content, Options{TrimMode: TrimExact, ChunkSize: 4096})
+    lines := source_lines(content, TrimExact)
+
+    // The first three lines, as test-it asks for them, then every line in one go
+    want := "OK\r\n" + lines[0] + "\r\nOK\r\n" + lines[1] + "\r\nOK\r\n" + lines[2] + "\r\n"
+    if reply := exchange(t, addr, "GET 1\r\nGET 2\r\nGET 3\r\n"); string(reply) != want {
+        t.Errorf("got %q, want %q", reply, want)
+    }
+
+    var requests, expected bytes.Buffer
+    for i, line := range lines {
+        fmt.Fprintf(&requests, "GET %d\r\n", i + 1)
+        fmt.Fprintf(&expected, "OK\r\n%s\r\n", line)
+    }
+    if reply := exchange(t, addr, requests.String()); !bytes.Equal(reply, expected.Bytes()) {
+        t.Errorf("got %d bytes, want %d bytes", len(reply), expected.Len())
+    }
+
+    // Ranges and batches return the same bytes
+    expected.Reset()
+    fmt.Fprintf(&expected, "OK %d\r\n", len(lines))
+    for _, line := range lines {
+        fmt.Fprintf(&expected, "%s\r\n", line)
+    }
+    if reply := exchange(t, addr, fmt.Sprintf("GET 1-%d\r\n", len(lines))); !bytes.Equal(reply, expected.Bytes()) {
+        t.Errorf("GET 1-%d: got %d bytes, want %d bytes", len(lines), len(reply), expected.Len())
+    }
+
+    expected.Reset()
+    fmt.Fprintf(&expected, "OK\r\nOK 3\r\nOK %d\r\n%s\r\nERR\r\nOK %d\r\n%s\r\n", len(lines[49]), lines[49], len(lines[0]), lines[0])
+    if reply := exchange(t, addr, "FRAMING length\r\nMGET 50 101 1\r\n"); !bytes.Equal(reply, expected.Bytes()) {
+        t.Errorf("MGET: got %q, want %q", reply, expected.Bytes())
+    }
+}
+
+func TestConformanceQuitAndRejoin(t *testing.T) {
+    srv, addr, _ := start_test_server(t, "first\nsecond\n", Options{})
+
+    // QUIT closes the connection without a response, and without ending the server
+    if reply := exchange(t, addr, "QUIT\r\nGET 1\r\n"); len(reply) != 0 {
+        t.Errorf("QUIT: got %q, want no response", reply)
+    }
+    for i := 0; i < 3; i++ {
+        if reply := exchange(t, addr, "GET 1\r\n"); string(reply) != "OK\r\nfirst\r\n" {
+            t.Errorf("after QUIT: got %q", reply)
+        }
+    }
+    if _, _, total := srv.Clients(); total != 4 {
+        t.Errorf("%d clients served, want 4", total)
+    }
+}
+
+func TestConformanceMalformed(t *testing.T) {
+    _, addr, _ := start_test_server(t, "first\nsecond\n", Options{})
+
+    for _, request := range []string{
+        "\r\n",
+        "GET\r\n",
+        "GET \r\n",
+        "GET x\r\n",
+        "GET -1\r\n",
+        "GET +1\r\n",
+        "GET 1 2\r\n",
+        "GET  1\r\n",
+        "GET 1 \r\n",
+        "get 1\r\n",
+        "GET 1\n",
+        "GET 1\r\r\n",
+        "GET 2-1\r\n",
+        "GET 1-\r\n",
+        "GETRANGE 1 0\r\n",
+        "MGET\r\n",
+        "MGET 1,2\r\n",
+        "FRAMING xml\r\n",
+        "TAIL 0\r\n",
+        "HELLO\r\n",
+        "QUIT now\r\n",
+        strings.Repeat("X", 100000) + "\r\n",
+    } {
+        // Each malformed command is answered with ERR, and the connection remains usable
+        reply := exchange(t, addr, request + "GET 2\r\n")
+        if string(reply) != "ERR\r\nOK\r\nsecond\r\n" {
+            t.Errorf("%.20q: got %q", request, reply)
+        }
+    }
+}
+
+func TestConformanceOutOfRange(t *testing.T) {
+    _, addr, _ := start_test_server(t, "first\nsecond\nthird", Options{})
+
+    for _, request := range []string{
+        "GET 0\r\n",
+        "GET 4\r\n",
+        "GET 18446744073709551615\r\n",
+        "GET 18446744073709551616\r\n",
+        "GET 99999999999999999999999\r\n",
+        "GET 2-4\r\n",
+        "GET 0-1\r\n",
+        "GETRANGE 3 2\r\n",
+    } {
+        reply := exchange(t, addr, request + "GET 3\r\n")
+        if string(reply) != "ERR\r\nOK\r\nthird\r\n" {
+            t.Errorf("%q: got %q", request, reply)
+        }
+    }
+    if reply := exchange(t, addr, "MGET 4 3 0\r\n"); string(reply) != "OK 3\r\nERR\r\nOK\r\nthird\r\nERR\r\n" {
+        t.Errorf("MGET: got %q", reply)
+    }
+}
+
+func TestConformanceShutdown(t *testing.T) {
+    long := strings.Repeat("0123456789", 400000)
+    srv, addr, served := start_test_server(t, "a\n" + long + "\n", Options{ShutdownPolicy: ShutdownLoopback, ChunkSize: 4096})
+
+    // Idle clients, and a busy one that doesn't read its long line until the server is shutting down
+    dial := func() net.Conn {
+        conn, err := net.Dial("tcp", addr)
+        if err != nil {
+            t.Fatal(err)
+        }
+        conn.SetDeadline(time.Now().Add(10 * time.Second))
+        conn.Write([]byte("COUNT\r\n"))
+        if reply := make([]byte, 7); !read_full(conn, reply) || string(reply) != "OK\r\n2\r\n" {
+            t.Fatalf("COUNT: got %q", reply)
+        }
+        return conn
+    }
+    var idle []net.Conn
+    for i := 0; i < 5; i++ {
+        idle = append(idle, dial())
+    }
+    busy := dial()
+    busy.Write([]byte("GET 2\r\n"))
+    time.Sleep(100 * time.Millisecond)
+
+    // SHUTDOWN from several clients at once, and from a signal handler
+    var senders []net.Conn
+    for i := 0; i < 5; i++ {
+        senders = append(senders, dial())
+    }
+    var wg sync.WaitGroup
+    for _, conn := range senders {
+        conn := conn
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            defer conn.Close()
+            // A connection drained before its SHUTDOWN is read may be reset, rather than closed
+            conn.Write([]byte("SHUTDOWN\r\n"))
+            if reply, _ := ioutil.ReadAll(conn); len(reply) != 0 {
+                t.Errorf("SHUTDOWN: got %q, want no response", reply)
+            }
+        }()
+    }
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+        defer cancel()
+        srv.Shutdown(ctx)
+    }()
+
+    select {
+    case err := <-served:
+        if err != ErrServerClosed {
+            t.Errorf("Serve returned %v, want %v", err, ErrServerClosed)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Serve did not return after SHUTDOWN")
+    }
+
+    // The busy client gets all of its line, and then the connection is closed
+    reply, err := ioutil.ReadAll(busy)
+    if err != nil || string(reply) != "OK\r\n" + long + "\r\n" {
+        t.Errorf("busy client: got %d bytes %v, want %d", len(reply), err, len(long) + 6)
+    }
+    for _, conn := range idle {
+        if reply, err := ioutil.ReadAll(conn); err != nil || len(reply) != 0 {
+            t.Errorf("idle client: got %q %v, want EOF", reply, err)
+        }
+    }
+    wg.Wait()
+
+    if conn, err := net.Dial("tcp", addr); err == nil {
+        conn.Close()
+        t.Error("server still accepting connections after shutdown")
+    }
+}
+
+func TestConformanceShutdownDenied(t *testing.T) {
+    _, addr, _ := start_test_server(t, "a\n", Options{})
+    if reply := exchange(t, addr, "SHUTDOWN\r\nSHUTDOWN token\r\nGET 1\r\n"); string(reply) != "DENIED\r\nDENIED\r\nOK\r\na\r\n" {
+        t.Errorf("got %q", reply)
+    }
+    if reply := exchange(t, addr, "GET 1\r\n"); string(reply) != "OK\r\na\r\n" {
+        t.Errorf("after SHUTDOWN was denied: got %q", reply)
+    }
+}
+
+func TestConformanceIdleTimeout(t *testing.T) {
+    idle := 200 * time.Millisecond
+    _, addr, _ := start_test_server(t, "a\n", Options{IdleTimeout: idle})
+
+    quiet, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer quiet.Close()
+    chatty, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer chatty.Close()
+
+    // A client that keeps sending commands outlives the idle timeout; a quiet one doesn't
+    start := time.Now()
+    reply := make([]byte, 7)
+    for time.Since(start) < 3 * idle {
+        chatty.SetDeadline(time.Now().Add(time.Second))
+        chatty.Write([]byte("GET 1\r\n"))
+        if !read_full(chatty, reply) || string(reply) != "OK\r\na\r\n" {
+            t.Fatalf("active client: got %q", reply)
+        }
+        time.Sleep(idle / 4)
+    }
+
+    quiet.SetDeadline(time.Now().Add(time.Second))
+    if reply, err := ioutil.ReadAll(quiet); err != nil || len(reply) != 0 {
+        t.Errorf("idle client: got %q %v, want EOF", reply, err)
+    }
+    if elapsed := time.Since(start); elapsed < 3 * idle {
+        t.Errorf("idle client closed after %s", elapsed)
+    }
+}
+
+//
+// Function: read_full
+//
+// Purpose: Reads exactly len(b) bytes, reporting whether they arrived
+//
+func read_full(conn net.Conn, b []byte) bool {
+    for n := 0; n < len(b); {
+        m, err := conn.Read(b[n:])
+        if err != nil {
+            return false
+        }
+        n += m
+    }
+    return true
+}
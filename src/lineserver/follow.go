@@ -0,0 +1,264 @@
+package lineserver
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io"
+    "os"
+    "sync/atomic"
+    "time"
+)
+
+const follow_scan_size = 64 * 1024  // Bytes of appended source read at a time
+const follow_batch_lines = 32 * 1024  // Lines whose records are held in memory at a time
+
+var errSourceReplaced = errors.New("source file was truncated, rotated or rewritten")
+var errIndexFixed = errors.New("index can't be extended in place")
+
+//
+// GoRoutine: follow_source
+//
+// Purpose: Watches the source file for appended lines (tail -f semantics), polling it every
+//          interval until the server shuts down
+//
+func follow_source(state *serverState, interval time.Duration) {
+    defer state.Done()
+
+    state.opts.Logger.Printf("Following source file, polling every %s\n", interval)
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            follow_once(state)
+        case <-state.ShuttingDown():
+            state.opts.Logger.Println("Follower received shutdown signal")
+            return
+        }
+    }
+}
+
+//
+// Function: follow_once
+//
+// Purpose: Indexes any lines appended to the source file since the last poll. A source file that
+//          was truncated, or replaced by another file, or is served through an index that can't
+//          be extended, is reindexed in full instead. Polls are skipped while a reload is in
+//          progress.
+//
+func follow_once(state *serverState) {
+    if !atomic.CompareAndSwapInt32(&state.reloading, 0, 1) {
+        return
+    }
+    defer atomic.StoreInt32(&state.reloading, 0)
+
+    cfg := state.Acquire()
+    if cfg == nil {
+        return  // The server has stopped
+    }
+    err := extend_snapshot(cfg)
+    cfg.Release()
+
+    switch err {
+    case nil:
+    case errSourceReplaced:
+        state.opts.Logger.Printf("Follow: '%s' was replaced; reindexing\n", cfg.GetSource())
+        if err := reload_snapshot(state, true); err != nil {
+            state.opts.Logger.Println("Reload failed:", err)
+        }
+    case errIndexFixed:
+        state.opts.Logger.Printf("Follow: '%s' has grown; reindexing\n", cfg.GetSource())
+        if err := reload_snapshot(state, false); err != nil {
+            state.opts.Logger.Println("Reload failed:", err)
+        }
+    default:
+        state.opts.Logger.Println("Follow failed:", err)
+    }
+}
+
+//
+// Function: extend_snapshot
+//
+// Purpose: Adds the records of the lines appended to the source file, and of a partial last line
+//          that has grown, to the snapshot's index file and index a batch at a time, then
+//          publishes the new lines in its line store. Returns errSourceReplaced if the snapshot
+//          can't be extended in place, and errIndexFixed if its index can't grow.
+//
+func extend_snapshot(cfg *clientConfig) error {
+    store := cfg.zones.store
+
+    info, err := os.Stat(cfg.GetSource())
+    if err != nil {
+        return err  // e.g. in the middle of a rotation; try again on the next poll
+    }
+
+    // A source file that was replaced by another can only be detected through the default Store
+    if f, ok := store.src.(*os.File); ok {
+        have, err := f.Stat()
+        if err != nil {
+            return err
+        }
+        if !os.SameFile(info, have) {
+            return errSourceReplaced
+        }
+    }
+
+    hdr := store.GetHeader()
+    size := info.Size()
+    switch {
+    case size < int64(hdr.SourceSize):
+        return errSourceReplaced
+    case size == int64(hdr.SourceSize):
+        return nil
+    }
+    if _, ok := store.index.(extendableIndex); !ok {
+        return errIndexFixed   // e.g. a custom index from Options.OpenIndex
+    }
+
+    // Scanning resumes at the end of the last indexed line, or at its start if it was partial
+    var start uint64
+    first := hdr.Lines + 1
+    if hdr.Lines > 0 {
+        offset, length, err := store.index.Lookup(hdr.Lines)
+        if err != nil {
+            return err
+        }
+
+        // A complete last line must still end where it did, or the file was rewritten
+        var last [1]byte
+        if err := read_at(store.src, last[:], offset + length - 1); err != nil {
+            return err
+        }
+        switch {
+        case store.IsPartial():
+            start, first = offset, hdr.Lines
+        case last[0] != '\n':
+            return errSourceReplaced
+        default:
+            start = offset + length
+        }
+    }
+
+    // Describe the source file as far as it is scanned; scanning stops at size
+    fp, err := source_fingerprint(io.NewSectionReader(store.src, 0, size), size)
+    if err != nil {
+        return err
+    }
+    hdr.SourceSize = uint64(size)
+    hdr.SourceMtime = info.ModTime().UnixNano()
+    hdr.Fingerprint = fp
+
+    // The records are written to the index file, and added to the index, a batch at a time
+    idx, err := os.OpenFile(cfg.GetIndex(), os.O_WRONLY, 0)
+    if err != nil {
+        return err
+    }
+    defer idx.Close()
+    if _, err := idx.Seek(index_header_size + int64(first - 1) * index_record_size, io.SeekStart); err != nil {
+        return err
+    }
+    writer := bufio.NewWriterSize(idx, follow_scan_size)
+
+    published := hdr.Lines
+    next := first
+    var last [2]uint64  // Record of the last line scanned
+    err = scan_lines(store.src, start, uint64(size), func(records []uint64) error {
+        // A partial last line's record has been published, so lookups must not see it half rewritten
+        if next <= published {
+            store.rewrite.Lock()
+            defer store.rewrite.Unlock()
+        }
+        if err := binary.Write(writer, binary.LittleEndian, records); err != nil {
+            return err
+        }
+        if err := writer.Flush(); err != nil {
+            return err
+        }
+        if err := store.ExtendIndex(next, records); err != nil {
+            return err
+        }
+        next += uint64(len(records) / 2)
+        copy(last[:], records[len(records) - 2:])
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    partial := false
+    if next > first {
+        var end [1]byte
+        if err := read_at(store.src, end[:], last[0] + last[1] - 1); err != nil {
+            return err
+        }
+        partial = end[0] != '\n'
+    }
+
+    // The header is rewritten last. If the server stops before then, the index no longer matches
+    // its header, and is rebuilt on the next start.
+    hdr.Lines = next - 1
+    var head bytes.Buffer
+    binary.Write(&head, binary.LittleEndian, &hdr)
+    if _, err := idx.WriteAt(head.Bytes(), 0); err != nil {
+        return err
+    }
+    store.Extend(hdr, partial, next > first)
+
+    if next > first {
+        cfg.zones.store.logger.Printf("Follow: indexed lines %d-%d of '%s'\n", first, hdr.Lines, cfg.GetSource())
+    }
+    return nil
+}
+
+//
+// Function: scan_lines
+//
+// Purpose: Finds the {offset, length} records of the lines between offsets start and end of the
+//          source file, and passes them to emit in batches of at most follow_batch_lines lines.
+//          The batch is reused once emit returns. The last line need not end with a newline.
+//
+func scan_lines(src io.ReaderAt, start uint64, end uint64, emit func(records []uint64) error) error {
+    records := make([]uint64, 0, follow_batch_lines * 2)
+
+    buffer := make([]byte, follow_scan_size)
+    line := start
+    for pos := start; pos < end; {
+        n := uint64(len(buffer))
+        if end - pos < n {
+            n = end - pos
+        }
+        if err := read_at(src, buffer[:n], pos); err != nil {
+            return err
+        }
+
+        for s := buffer[:n]; ; {
+            eol := bytes.IndexByte(s, '\n')
+            if eol < 0 {
+                break
+            }
+            next := pos + uint64(n) - uint64(len(s)) + uint64(eol) + 1
+            records = append(records, line, next - line)
+            line = next
+            s = s[eol + 1:]
+
+            if len(records) == cap(records) {
+                if err := emit(records); err != nil {
+                    return err
+                }
+                records = records[:0]
+            }
+        }
+        pos += n
+    }
+    if line < end {
+        records = append(records, line, end - line)
+    }
+
+    if len(records) > 0 {
+        return emit(records)
+    }
+    return nil
+}
@@ -0,0 +1,219 @@
+package lineserver
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func TestFollowPartialLine(t *testing.T) {
+    // Each index mode extends its records differently
+    for _, mode := range index_modes() {
+        t.Run(mode, func(t *testing.T) {
+            source_file := write_source(t, "a\nb")
+            cfg := open_snapshot(source_file, true, test_options(t, Options{IndexMode: mode}))
+            if cfg == nil {
+                t.Fatal("open_snapshot failed")
+            }
+            defer cfg.Release()
+
+            if lines := cfg.zones.store.CompleteLines(); lines != 1 {
+                t.Fatalf("%d complete lines, want 1", lines)
+            }
+            expect_reply(t, cfg.zones, 2, "OK\r\nb\r\n")
+
+            f, err := os.OpenFile(source_file, os.O_WRONLY | os.O_APPEND, 0)
+            if err != nil {
+                t.Fatal(err)
+            }
+            f.WriteString("c\nd\n")
+            f.Close()
+
+            if err := extend_snapshot(cfg); err != nil {
+                t.Fatal(err)
+            }
+            if lines := cfg.zones.store.CompleteLines(); lines != 3 {
+                t.Fatalf("%d complete lines, want 3", lines)
+            }
+            if lines := cfg.GetLines(); lines != 3 {
+                t.Errorf("snapshot has %d lines, want 3", lines)
+            }
+            expect_reply(t, cfg.zones, 2, "OK\r\nbc\r\n")
+            expect_reply(t, cfg.zones, 3, "OK\r\nd\r\n")
+
+            // The index file was extended in place, and describes the whole source file
+            hdr, err := read_index_header(cfg.GetIndex())
+            if err != nil {
+                t.Fatal(err)
+            }
+            if hdr.SourceSize != 7 {
+                t.Errorf("index header source size %d, want 7", hdr.SourceSize)
+            }
+            want := expected_records("a\nbc\nd\n")
+            index, err := load_memory_index(cfg.GetIndex(), hdr.Lines)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(index.table, want) {
+                t.Fatalf("index %v, want %v", index.table, want)
+            }
+        })
+    }
+}
+
+func TestFollowReindex(t *testing.T) {
+    cases := []struct {
+        name    string
+        replace func(t *testing.T, source_file string)
+    }{
+        {"truncated", func(t *testing.T, source_file string) {
+            if err := ioutil.WriteFile(source_file, []byte("x\n"), 0644); err != nil {
+                t.Fatal(err)
+            }
+        }},
+        {"rotated", func(t *testing.T, source_file string) {
+            // Same size, but another file
+            rotated := filepath.Join(filepath.Dir(source_file), "rotated.txt")
+            if err := ioutil.WriteFile(rotated, []byte("x\ny\nz\n"), 0644); err != nil {
+                t.Fatal(err)
+            }
+            if err := os.Rename(rotated, source_file); err != nil {
+                t.Fatal(err)
+            }
+        }},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            source_file := write_source(t, "a\nb\nc\n")
+            opts := test_options(t, Options{})
+            cfg := open_snapshot(source_file, true, opts)
+            if cfg == nil {
+                t.Fatal("open_snapshot failed")
+            }
+            state := new_server_state(opts, cfg)
+            defer func() { state.current.Release() }()     // Whichever snapshot is served by then
+
+            tc.replace(t, source_file)
+            if err := extend_snapshot(cfg); err != errSourceReplaced {
+                t.Fatalf("extend_snapshot returned %v, want %v", err, errSourceReplaced)
+            }
+
+            // The follower reindexes the new file in full, and retires the old snapshot
+            follow_once(state)
+            if !cfg.zones.store.Retired() {
+                t.Error("old snapshot was not retired")
+            }
+            current := state.Acquire()
+            defer current.Release()
+            content, _ := ioutil.ReadFile(source_file)
+            want := source_lines(string(content), opts.TrimMode)
+            if lines := current.GetLines(); lines != uint64(len(want)) {
+                t.Fatalf("%d lines after reindex, want %d", lines, len(want))
+            }
+            expect_reply(t, current.zones, 1, "OK\r\nx\r\n")
+        })
+    }
+}
+
+func TestFollowCustomIndex(t *testing.T) {
+    // An index plugged in without Extend can't grow in place
+    source_file := write_source(t, "a\nb\n")
+    opts := test_options(t, Options{
+        OpenIndex: func(index_file string, lines uint64) (Index, error) {
+            m, err := load_memory_index(index_file, lines)
+            return &CountingIndex{Index: m}, err
+        },
+    })
+    cfg := open_snapshot(source_file, true, opts)
+    if cfg == nil {
+        t.Fatal("open_snapshot failed")
+    }
+    state := new_server_state(opts, cfg)
+    defer func() { state.current.Release() }()
+    if kind := index_kind(cfg.zones.store.index); kind != "custom" {
+        t.Errorf("%s index, want custom", kind)
+    }
+
+    f, err := os.OpenFile(source_file, os.O_WRONLY | os.O_APPEND, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.WriteString("c\n")
+    f.Close()
+    if err := extend_snapshot(cfg); err != errIndexFixed {
+        t.Fatalf("extend_snapshot returned %v, want %v", err, errIndexFixed)
+    }
+
+    // The follower reindexes the file in full instead
+    follow_once(state)
+    current := state.Acquire()
+    defer current.Release()
+    if lines := current.GetLines(); lines != 3 {
+        t.Fatalf("%d lines after reindex, want 3", lines)
+    }
+    expect_reply(t, current.zones, 3, "OK\r\nc\r\n")
+}
+
+func TestFollowBatches(t *testing.T) {
+    // Enough appended lines for several batches, the first of them finishing a partial line
+    var appended bytes.Buffer
+    for i := 0; i < follow_batch_lines * 2 + 5; i++ {
+        fmt.Fprintf(&appended, "%d\n", i)
+    }
+    batches := 0
+    err := scan_lines(bytes.NewReader(appended.Bytes()), 0, uint64(appended.Len()), func(records []uint64) error {
+        if len(records) > follow_batch_lines * 2 {
+            t.Fatalf("batch of %d lines, want at most %d", len(records) / 2, follow_batch_lines)
+        }
+        batches++
+        return nil
+    })
+    if err != nil || batches != 3 {
+        t.Fatalf("%d batches %v, want 3", batches, err)
+    }
+
+    for _, mode := range index_modes() {
+        t.Run(mode, func(t *testing.T) {
+            source_file := write_source(t, "a\nb")
+            cfg := open_snapshot(source_file, true, test_options(t, Options{IndexMode: mode}))
+            if cfg == nil {
+                t.Fatal("open_snapshot failed")
+            }
+            defer cfg.Release()
+
+            f, err := os.OpenFile(source_file, os.O_WRONLY | os.O_APPEND, 0)
+            if err != nil {
+                t.Fatal(err)
+            }
+            f.Write(appended.Bytes())
+            f.Close()
+
+            if err := extend_snapshot(cfg); err != nil {
+                t.Fatal(err)
+            }
+            content := "a\nb" + appended.String()
+            want := expected_records(content)
+            if lines := cfg.zones.store.GetLines(); lines != uint64(len(want) / 2) {
+                t.Fatalf("%d lines, want %d", lines, len(want) / 2)
+            }
+            expect_reply(t, cfg.zones, 2, "OK\r\nb0\r\n")
+            expect_reply(t, cfg.zones, uint64(len(want) / 2), fmt.Sprintf("OK\r\n%d\r\n", follow_batch_lines * 2 + 4))
+
+            hdr, err := read_index_header(cfg.GetIndex())
+            if err != nil {
+                t.Fatal(err)
+            }
+            index, err := load_memory_index(cfg.GetIndex(), hdr.Lines)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(index.table, want) {
+                t.Fatal("index file doesn't match the source file")
+            }
+        })
+    }
+}
@@ -0,0 +1,219 @@
+package lineserver
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+)
+
+//
+//  protocol object - how the clients of one listener are served, and turned away
+//
+type protocol struct {
+    name    string
+    handler func(client net.Conn, idle time.Duration, state *serverState, admin bool)
+    busy    []byte      // Sent to a client that is turned away by admission control
+}
+
+var text_protocol = &protocol{"text", client_handler, []byte("BUSY\r\n")}
+
+//
+// GoRoutine: client_handler
+//
+// Purpose: Validates and executes client commands
+//
+func client_handler(client net.Conn, idle time.Duration, state *serverState, admin bool) {
+    state.Track(client)
+    cfg := state.Acquire()  // This connection is served from the same snapshot until it closes
+    zones := cfg.zones
+
+    // client handler closure
+    defer func() {
+        state.opts.Logger.Printf("Closing socket to %s\n", client.RemoteAddr().String())
+        cfg.Release()
+        state.Untrack(client)
+        client.Close()  // Close client socket
+        state.clients.Release(admin)    // Free the client's slot
+        state.Done()    // Decrement the WaitGroup
+    }()
+
+    reader := bufio.NewReader(client)
+    out := &stallConn{client, state.opts.WriteTimeout}  // A client that stops reading is disconnected
+    writer := bufio.NewWriter(out)
+    framing := framing_line    // Until the client negotiates otherwise
+    done := false
+
+    // Client command-response loop
+    for !done {
+        // Set idle timeout; at shutdown, the wait is cut short by Drain
+        state.SetIdleDeadline(client, idle)
+
+        msg, err := reader.ReadString('\n')
+        if err != nil {
+            if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+                if state.IsShutdown() {
+                    state.opts.Logger.Println("Client received shutdown signal")
+                } else {
+                    state.opts.Logger.Println("Client idle timeout")
+                }
+            } else {
+                state.opts.Logger.Println("Client read error: ", err)
+            }
+            break
+        }
+
+        // Regex match command string
+        cmd, args := parse_command(msg)
+        if cmd == "" {
+            writer.WriteString("ERR\r\n")
+            writer.Flush()
+            continue
+        }
+        if cmd == "SHUTDOWN" || cmd == "RELOAD" {
+            state.opts.Logger.Println("Command: " + cmd)    // Never log the admin token
+        } else {
+            state.opts.Logger.Println("Command: " + strings.TrimSpace(msg))
+        }
+
+        var err2 error
+        switch cmd {
+        case "QUIT":
+            done = true
+        case "SHUTDOWN":    // SHUTDOWN [token]
+            if !authorize_admin(state.opts, client, admin, args[0]) {
+                state.opts.Logger.Printf("Refused SHUTDOWN from %s\n", client.RemoteAddr().String())
+                _, err2 = writer.WriteString("DENIED\r\n")
+                break
+            }
+            done = true
+            state.InitiateShutdown() // Signal server to exit
+        case "GET":     // GET nnnn, or GET first-last
+            first, err1 := strconv.ParseUint(args[0], 10, 64)
+            if err1 != nil {
+                _, err2 = writer.WriteString("ERR\r\n")
+            } else if args[1] == "" {
+                // Located by the owner of the line's zone, and copied to the socket in chunks
+                err2 = write_text(writer, zones.Get(first), framing)
+            } else if last, err1 := strconv.ParseUint(args[1], 10, 64); err1 != nil || first < 1 || last < first {
+                _, err2 = writer.WriteString("ERR\r\n")
+            } else {
+                err2 = write_range(writer, zones, first, last - first + 1, framing)
+            }
+        case "MGET":    // MGET nnnn [nnnn ...]
+            var lines []uint64
+            for _, arg := range strings.Fields(args[0]) {
+                line, err1 := strconv.ParseUint(arg, 10, 64)
+                if err1 != nil {
+                    lines = nil
+                    break
+                }
+                lines = append(lines, line)
+            }
+            if lines == nil {
+                _, err2 = writer.WriteString("ERR\r\n")
+            } else {
+                err2 = write_mget(writer, zones, lines, framing)
+            }
+        case "RELOAD":  // RELOAD [token]
+            if !authorize_admin(state.opts, client, admin, args[0]) {
+                state.opts.Logger.Printf("Refused RELOAD from %s\n", client.RemoteAddr().String())
+                _, err2 = writer.WriteString("DENIED\r\n")
+                break
+            }
+            switch err1 := reload_source(state); err1 {
+            case nil:
+                _, err2 = writer.WriteString("OK\r\n")
+            case ErrReloadInProgress:
+                _, err2 = writer.WriteString("BUSY\r\n")
+            default:
+                state.opts.Logger.Println("Reload failed:", err1)
+                _, err2 = writer.WriteString("ERR\r\n")
+            }
+        case "FRAMING": // FRAMING line|length
+            framing = args[0]
+            _, err2 = writer.WriteString("OK\r\n")
+        case "COUNT":
+            _, err2 = fmt.Fprintf(writer, "OK\r\n%d\r\n", zones.store.GetLines())
+        case "STAT":
+            _, err2 = fmt.Fprintf(writer, "OK\r\n%s\r\n", stat_line(zones.store))
+        case "INFO":
+            err2 = write_info(writer, state, zones)
+        case "TAIL":    // TAIL from
+            from, err1 := strconv.ParseUint(args[0], 10, 64)
+            if err1 != nil || from < 1 || state.opts.FollowInterval == 0 {
+                // Without follow mode no lines are ever appended
+                _, err2 = writer.WriteString("ERR\r\n")
+                break
+            }
+            // The connection stays in push mode until the tail ends
+            err2 = tail_lines(out, reader, writer, state, zones, from, framing)
+            done = true
+        case "GETRANGE":    // GETRANGE first count
+            first, err1 := strconv.ParseUint(args[0], 10, 64)
+            count, err3 := strconv.ParseUint(args[1], 10, 64)
+            if err1 != nil || err3 != nil || count < 1 {
+                _, err2 = writer.WriteString("ERR\r\n")
+            } else {
+                err2 = write_range(writer, zones, first, count, framing)
+            }
+        }
+        if err2 == nil {
+            err2 = writer.Flush()
+        }
+        if err2 != nil {
+            state.opts.Logger.Println("Client write error: ", err2)
+            done = true
+        }
+    }
+}
+
+//
+// Function: wait_for_clients
+//
+// Purpose: Waits for client connections. Dispatches one new client handler per client connection,
+//          for the listener's protocol. Connections accepted on the admin listener are marked as
+//          admin connections. Returns ErrServerClosed once the server shuts down.
+//
+func wait_for_clients(listen_conn net.Listener, state *serverState, admin bool, proto *protocol) error {
+
+    // Listener closure
+    defer func() {
+        state.opts.Logger.Printf("Closing listener on %s:%s\n", listen_conn.Addr().Network(), listen_conn.Addr().String())
+        listen_conn.Close() // Close listener socket
+    }()
+
+    state.opts.Logger.Printf("Listening for %s clients on %s:%s\n", proto.name, listen_conn.Addr().Network(), listen_conn.Addr().String())
+
+    // Closing the listener at shutdown ends the wait in Accept
+    stop := make(chan struct{})
+    defer close(stop)
+    go func() {
+        select {
+        case <-state.ShuttingDown():
+            listen_conn.Close()
+        case <-stop:
+        }
+    }()
+
+    // Main loop for launching new clients
+    for {
+        client, err := listen_conn.Accept()
+        if err != nil {
+            if state.IsShutdown() {
+                state.opts.Logger.Println("Listener received shutdown signal")
+                return ErrServerClosed
+            }
+            state.opts.Logger.Println("Accept error: ", err)
+            state.InitiateShutdown()    // Signal server to exit
+            return err
+        }
+
+        // Launch new client handler, once the client is admitted
+        state.opts.Logger.Printf("Connection from %s\n", client.RemoteAddr().String())
+        state.Starting() // Increment the WaitGroup
+        go admit_client(client, state, admin, proto)
+    }
+}
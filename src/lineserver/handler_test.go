@@ -0,0 +1,139 @@
+package lineserver
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "regexp"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func TestLengthFraming(t *testing.T) {
+    cfg := open_snapshot(write_source(t, "a,\"b\rc\"\r\nx\x00y\n\r\n\r"), true, test_options(t, Options{TrimMode: TrimExact}))
+    if cfg == nil {
+        t.Fatal("open_snapshot failed")
+    }
+    defer cfg.Release()
+
+    var out bytes.Buffer
+    for line := uint64(1); line <= 5; line++ {
+        if err := write_text(&out, cfg.zones.Get(line), framing_length); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := write_range(&out, cfg.zones, 1, 4, framing_length); err != nil {
+        t.Fatal(err)
+    }
+    if err := write_mget(&out, cfg.zones, []uint64{2, 9, 1}, framing_length); err != nil {
+        t.Fatal(err)
+    }
+
+    want := "OK 7\r\na,\"b\rc\"\r\n" + "OK 3\r\nx\x00y\r\n" + "OK 0\r\n\r\n" + "OK 1\r\n\r\r\n" + "ERR\r\n" +
+        "OK 4\r\n" + "7\r\na,\"b\rc\"\r\n" + "3\r\nx\x00y\r\n" + "0\r\n\r\n" + "1\r\n\r\r\n" +
+        "OK 3\r\n" + "OK 3\r\nx\x00y\r\n" + "ERR\r\n" + "OK 7\r\na,\"b\rc\"\r\n"
+    if out.String() != want {
+        t.Fatalf("%q, want %q", out.String(), want)
+    }
+}
+
+func TestFramingCommand(t *testing.T) {
+    client, _ := start_handler(t, "a\r\nb\n", client_handler)
+
+    // Length framing applies from the next command on, until the client switches back
+    go client.Write([]byte("GET 1\r\nFRAMING length\r\nGET 1\r\nMGET 2\r\nFRAMING line\r\nGET 2\r\nQUIT\r\n"))
+    have, err := ioutil.ReadAll(client)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := "OK\r\na\r\n" + "OK\r\n" + "OK 1\r\na\r\n" + "OK 1\r\nOK 1\r\nb\r\n" + "OK\r\n" + "OK\r\nb\r\n"
+    if string(have) != want {
+        t.Fatalf("%q, want %q", have, want)
+    }
+}
+
+func TestCountCommand(t *testing.T) {
+    client, _ := start_handler(t, "a\nb\nc", client_handler)
+
+    go client.Write([]byte("COUNT\r\nQUIT\r\n"))
+    have, err := ioutil.ReadAll(client)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(have) != "OK\r\n3\r\n" {
+        t.Fatalf("%q, want %q", have, "OK\r\n3\r\n")
+    }
+}
+
+func TestStatCommand(t *testing.T) {
+    srv, addr, _ := start_test_server(t, "a\nb\n", Options{ShutdownPolicy: ShutdownLoopback})
+    stat := regexp.MustCompile(`^OK\r\nlines=(\d+) size=(\d+) mtime=(\d+) fingerprint=([0-9a-f]{16})\r\n$`)
+
+    before := stat.FindStringSubmatch(string(exchange(t, addr, "STAT\r\n")))
+    if before == nil || before[1] != "2" || before[2] != "4" {
+        t.Fatalf("STAT: got %q", before)
+    }
+    hdr := srv.state.current.GetHeader()
+    if before[3] != strconv.FormatInt(hdr.SourceMtime, 10) || before[4] != fmt.Sprintf("%016x", hdr.Fingerprint) {
+        t.Errorf("STAT %q doesn't describe the index header %+v", before[0], hdr)
+    }
+
+    // A rewritten and reloaded source file is described differently
+    replace_source(t, srv.state.current.GetSource(), "x\ny\nzz\n")
+    if reply := exchange(t, addr, "RELOAD\r\n"); string(reply) != "OK\r\n" {
+        t.Fatalf("RELOAD: got %q", reply)
+    }
+    after := stat.FindStringSubmatch(string(exchange(t, addr, "STAT\r\n")))
+    if after == nil || after[1] != "3" || after[2] != "7" {
+        t.Fatalf("STAT after reload: got %q", after)
+    }
+    if after[4] == before[4] {
+        t.Errorf("fingerprint %s unchanged after reload", after[4])
+    }
+}
+
+func TestInfoCommand(t *testing.T) {
+    client, _ := start_handler(t, "a\nb\nc\n", client_handler)
+    go client.Write([]byte("INFO\r\nCOUNT\r\nQUIT\r\n"))
+    reader := bufio.NewReader(client)
+
+    var count int
+    if header, err := reader.ReadString('\n'); err != nil {
+        t.Fatal(err)
+    } else if _, err := fmt.Sscanf(header, "OK %d\r\n", &count); err != nil {
+        t.Fatalf("header %q: %v", header, err)
+    }
+
+    // Exactly count fields follow, then the next response
+    names := []string{"version", "uptime_seconds", "lines", "source_size", "source_mtime", "source_fingerprint", "index_format",
+        "index_backend", "zones", "clients_connected", "clients_peak", "clients_total"}
+    if count != len(names) {
+        t.Fatalf("%d fields, want %d", count, len(names))
+    }
+    fields := map[string]string{}
+    for i := 0; i < count; i++ {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            t.Fatal(err)
+        }
+        field := strings.SplitN(strings.TrimSuffix(line, "\r\n"), ": ", 2)
+        if len(field) != 2 || field[0] != names[i] || field[1] == "" {
+            t.Fatalf("field %d: %q, want %s: <value>", i + 1, line, names[i])
+        }
+        fields[field[0]] = field[1]
+    }
+    rest, err := ioutil.ReadAll(reader)
+    if err != nil || string(rest) != "OK\r\n3\r\n" {
+        t.Fatalf("after the fields: %q %v, want the COUNT response", rest, err)
+    }
+
+    want := map[string]string{"version": server_version, "lines": "3", "source_size": "6", "index_format": "1",
+        "index_backend": IndexMemory, "clients_connected": "1"}
+    for name, value := range want {
+        if fields[name] != value {
+            t.Errorf("%s: %s, want %s", name, fields[name], value)
+        }
+    }
+}
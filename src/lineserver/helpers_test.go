@@ -0,0 +1,39 @@
+package lineserver
+
+import (
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+var long_line = strings.Repeat("long ", 30000)  // Several chunks, ending in whitespace
+
+//
+// Function: start_handler
+//
+// Purpose: Serves content to one client, connected by an in-memory pipe to a client handler of
+//          the given protocol, and returns the client's end of the pipe and the snapshot served.
+//          When the test ends, the pipe is closed, and the snapshot released once the client
+//          handler has exited.
+//
+func start_handler(t *testing.T, content string, handler func(net.Conn, time.Duration, *serverState, bool)) (net.Conn, *clientConfig) {
+    t.Helper()
+    opts := test_options(t, Options{})
+    cfg := open_snapshot(write_source(t, content), true, opts)
+    if cfg == nil {
+        t.Fatal("open_snapshot failed")
+    }
+    state := new_server_state(opts, cfg)
+    t.Cleanup(cfg.Release)
+
+    client, server := net.Pipe()
+    state.Starting()
+    state.clients.Admit(state, false)
+    go handler(server, 0, state, false)
+    t.Cleanup(func() {
+        client.Close()
+        state.Wait()
+    })
+    return client, cfg
+}
@@ -0,0 +1,551 @@
+package lineserver
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+//
+//  HTTP gateway. Serves the same retrieval as the text protocol, plus the INFO metadata:
+//
+//      GET /lines/42                   line 42
+//      GET /lines?from=10&to=20        lines 10 through 20 (either bound may be omitted)
+//      GET /lines  Range: lines=10-20  lines 10 through 20, as a 206 Partial Content response
+//      GET /info                       server metadata
+//
+//  Responses are raw text, one line per "\n"-terminated line of the body, or JSON with ?format=json
+//  (or "Accept: application/json"). HTTP requests are not counted against -c.
+//
+const (
+    format_text = "text"
+    format_json = "json"
+)
+
+const range_unit = "lines"  // Unit of the Range, Content-Range and Accept-Ranges headers
+
+//
+//  stallListener object - accepts HTTP gateway connections as stallConns, so that a client that
+//  stops reading its response is disconnected
+//
+type stallListener struct {
+    net.Listener
+    timeout time.Duration
+}
+
+func (l stallListener) Accept() (net.Conn, error) {
+    c, err := l.Listener.Accept()
+    if err != nil {
+        return nil, err
+    }
+    return &stallConn{c, l.timeout}, nil
+}
+
+//
+// Function: serve_http
+//
+// Purpose: Serves the HTTP gateway on listen_conn until the server shuts down. Requests in
+//          progress at shutdown are given until the drain deadline to finish.
+//
+func serve_http(listen_conn net.Listener, state *serverState) error {
+    srv := &http.Server{Handler: http_routes(state), IdleTimeout: state.opts.IdleTimeout}
+
+    state.opts.Logger.Printf("Listening for http clients on %s:%s\n", listen_conn.Addr().Network(), listen_conn.Addr().String())
+
+    stopped := make(chan error, 1)
+    go func() {
+        stopped <- srv.Serve(stallListener{listen_conn, state.opts.WriteTimeout})
+    }()
+
+    select {
+    case err := <-stopped:
+        state.opts.Logger.Println("HTTP serve error: ", err)
+        state.InitiateShutdown()    // Signal server to exit
+        return err
+    case <-state.ShuttingDown():
+        state.opts.Logger.Println("HTTP listener received shutdown signal")
+    }
+
+    // Requests in progress are cut short when the drain deadline passes, as for the other protocols
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go func() {
+        select {
+        case <-state.Closing():
+            cancel()
+        case <-ctx.Done():
+        }
+    }()
+    if err := srv.Shutdown(ctx); err != nil {
+        state.opts.Logger.Println("Closing all http connections")
+        srv.Close()
+    }
+    <-stopped
+    state.opts.Logger.Printf("Closing listener on %s:%s\n", listen_conn.Addr().Network(), listen_conn.Addr().String())
+    return ErrServerClosed
+}
+
+//
+// Function: http_routes
+//
+// Purpose: Maps the gateway's paths to their handlers. Every request is served from the snapshot
+//          current when it arrives.
+//
+func http_routes(state *serverState) http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/lines", http_handler(state, http_range))
+    mux.HandleFunc("/lines/", http_handler(state, http_line))
+    mux.HandleFunc("/info", http_handler(state, http_info))
+    return mux
+}
+
+//
+// Function: http_handler
+//
+// Purpose: Wraps a gateway handler with what every request needs: logging, the method and format
+//          checks, and a reference to the current snapshot
+//
+func http_handler(state *serverState, serve func(w http.ResponseWriter, r *http.Request, state *serverState, zones *zoneSet, format string)) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        state.opts.Logger.Printf("HTTP %s %s from %s\n", r.Method, r.URL.RequestURI(), r.RemoteAddr)
+
+        format := r.URL.Query().Get("format")
+        switch format {
+        case "":
+            format = format_text
+            if strings.Contains(r.Header.Get("Accept"), "application/json") {
+                format = format_json
+            }
+        case format_text, format_json:
+        default:
+            http_error(w, format_text, http.StatusBadRequest, "invalid format: " + format)
+            return
+        }
+
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            w.Header().Set("Allow", "GET, HEAD")
+            http_error(w, format, http.StatusMethodNotAllowed, "method not allowed")
+            return
+        }
+        var cfg *clientConfig
+        if !state.IsShutdown() {
+            cfg = state.Acquire()   // nil once the server has stopped
+        }
+        if cfg == nil {
+            w.Header().Set("Connection", "close")
+            http_error(w, format, http.StatusServiceUnavailable, "server is shutting down")
+            return
+        }
+        defer cfg.Release()
+        serve(w, r, state, cfg.zones, format)
+    }
+}
+
+//
+// Function: http_line
+//
+// Purpose: Serves GET /lines/<n>
+//
+func http_line(w http.ResponseWriter, r *http.Request, state *serverState, zones *zoneSet, format string) {
+    arg := strings.TrimPrefix(r.URL.Path, "/lines/")
+    if arg == "" {
+        http_range(w, r, state, zones, format)
+        return
+    }
+    line, err := strconv.ParseUint(arg, 10, 64)
+    if err != nil {
+        http_error(w, format, http.StatusBadRequest, "malformed line number: " + arg)
+        return
+    }
+    write_http_lines(w, state, zones.Get(line), line, 0, http.StatusOK, format, r.Method == http.MethodHead)
+}
+
+//
+// Function: http_range
+//
+// Purpose: Serves GET /lines, for the lines selected by the from and to parameters, or by a Range
+//          header. Either bound may be omitted; by default the whole file is served.
+//
+func http_range(w http.ResponseWriter, r *http.Request, state *serverState, zones *zoneSet, format string) {
+    lines := zones.store.GetLines()
+    w.Header().Set("Accept-Ranges", range_unit)
+
+    query := r.URL.Query()
+    spec := r.Header.Get("Range")
+    if spec != "" && !strings.HasPrefix(spec, range_unit + "=") {
+        spec = ""   // Some other unit, e.g. bytes: ignored, as RFC 7233 allows
+    }
+    if spec != "" && (query.Get("from") != "" || query.Get("to") != "") {
+        http_error(w, format, http.StatusBadRequest, "Range can't be combined with from and to")
+        return
+    }
+
+    first, last, status := uint64(1), lines, http.StatusOK
+    var err error
+    if spec != "" {
+        var satisfiable bool
+        if first, last, satisfiable, err = parse_line_range(spec, lines); err != nil {
+            http_error(w, format, http.StatusBadRequest, err.Error())
+            return
+        }
+        if !satisfiable {
+            w.Header().Set("Content-Range", fmt.Sprintf("%s */%d", range_unit, lines))
+            http_error(w, format, http.StatusRequestedRangeNotSatisfiable, "range not satisfiable")
+            return
+        }
+        status = http.StatusPartialContent
+        w.Header().Set("Content-Range", fmt.Sprintf("%s %d-%d/%d", range_unit, first, last, lines))
+    } else {
+        if first, err = parse_bound(query, "from", first); err == nil {
+            last, err = parse_bound(query, "to", last)
+        }
+        if err != nil {
+            http_error(w, format, http.StatusBadRequest, err.Error())
+            return
+        }
+        if query.Get("to") != "" && last < first {
+            http_error(w, format, http.StatusBadRequest, fmt.Sprintf("from %d is past to %d", first, last))
+            return
+        }
+        if last > lines {
+            last = lines    // Clamped to the end of the file, as for a Range header
+        }
+    }
+
+    if last < first {
+        // Nothing to serve: an empty file, or from just past its last line
+        if first > lines + 1 {
+            http_error(w, format, http.StatusNotFound, errOutOfRange.Error())
+            return
+        }
+        write_http_lines(w, state, nil, first, 0, status, format, r.Method == http.MethodHead)
+        return
+    }
+    write_http_lines(w, state, zones.GetRange(first, last - first + 1), first, last - first + 1, status, format, r.Method == http.MethodHead)
+}
+
+//
+// Function: parse_bound
+//
+// Purpose: Parses an optional line number query parameter. Line numbers start at 1.
+//
+func parse_bound(query map[string][]string, name string, def uint64) (uint64, error) {
+    values := query[name]
+    if len(values) == 0 || values[0] == "" {
+        return def, nil
+    }
+    n, err := strconv.ParseUint(values[0], 10, 64)
+    if err != nil || n < 1 {
+        return 0, fmt.Errorf("malformed %s: %s", name, values[0])
+    }
+    return n, nil
+}
+
+//
+// Function: parse_line_range
+//
+// Purpose: Parses a Range header of a single range of lines: "lines=a-b", "lines=a-" (from line a
+//          on) or "lines=-n" (the last n lines). As for byte ranges, a last line past the end of
+//          the file is clamped to it, and a range starting past the end can't be satisfied.
+//
+func parse_line_range(spec string, lines uint64) (uint64, uint64, bool, error) {
+    spec = strings.TrimSpace(strings.TrimPrefix(spec, range_unit + "="))
+    if strings.Contains(spec, ",") {
+        return 0, 0, false, fmt.Errorf("multiple ranges are not supported: %s", spec)
+    }
+    dash := strings.IndexByte(spec, '-')
+    if dash < 0 {
+        return 0, 0, false, fmt.Errorf("malformed range: %s", spec)
+    }
+    a, b := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash + 1:])
+
+    if a == "" {
+        // Suffix range: the last n lines
+        n, err := strconv.ParseUint(b, 10, 64)
+        if err != nil {
+            return 0, 0, false, fmt.Errorf("malformed range: %s", spec)
+        }
+        if n == 0 || lines == 0 {
+            return 0, 0, false, nil
+        }
+        if n > lines {
+            n = lines
+        }
+        return lines - n + 1, lines, true, nil
+    }
+
+    first, err := strconv.ParseUint(a, 10, 64)
+    if err != nil || first < 1 {
+        return 0, 0, false, fmt.Errorf("malformed range: %s", spec)
+    }
+    last := lines
+    if b != "" {
+        if last, err = strconv.ParseUint(b, 10, 64); err != nil || last < first {
+            return 0, 0, false, fmt.Errorf("malformed range: %s", spec)
+        }
+        if last > lines {
+            last = lines
+        }
+    }
+    return first, last, first <= lines, nil
+}
+
+//
+// Function: http_info
+//
+// Purpose: Serves GET /info: the INFO fields, as "name: value" lines or as a JSON object
+//
+func http_info(w http.ResponseWriter, r *http.Request, state *serverState, zones *zoneSet, format string) {
+    fields := info_fields(state, zones)
+
+    var body bytes.Buffer
+    if format == format_json {
+        body.WriteString("{")
+        for i, field := range fields {
+            if i > 0 {
+                body.WriteString(",")
+            }
+            name, _ := json.Marshal(field.name)
+            value, _ := json.Marshal(field.value)
+            fmt.Fprintf(&body, "%s:%s", name, value)
+        }
+        body.WriteString("}\n")
+    } else {
+        for _, field := range fields {
+            fmt.Fprintf(&body, "%s: %v\n", field.name, field.value)
+        }
+    }
+
+    set_content_type(w, format)
+    w.Write(body.Bytes())
+}
+
+//
+// Function: write_http_lines
+//
+// Purpose: Writes a textReply carrying count lines, from line first on, as the response body. A
+//          count of 0 writes a single line ({"line", "text"} in JSON); a nil reply writes an empty
+//          range. The status is sent only once the first line has been retrieved, so that an
+//          out-of-range request gets a 404. A failure after that can only cut the response short.
+//          A HEAD request gets the headers alone; the body is not read.
+//
+func write_http_lines(w http.ResponseWriter, state *serverState, reply *textReply, first uint64, count uint64, status int, format string, head bool) {
+    single := count == 0 && reply != nil
+    var hdr chunk
+    if reply != nil {
+        var ok bool
+        if hdr, ok = <-reply.chunks; !ok {
+            hdr.err = io.ErrUnexpectedEOF
+        }
+        if hdr.err != nil {
+            reply.Abandon()
+            if hdr.err == errOutOfRange {
+                http_error(w, format, http.StatusNotFound, hdr.err.Error())
+            } else {
+                http_error(w, format, http.StatusInternalServerError, hdr.err.Error())
+            }
+            return
+        }
+    }
+
+    set_content_type(w, format)
+    if single && format == format_text {
+        w.Header().Set("Content-Length", strconv.FormatUint(hdr.size + 1, 10))
+    }
+    w.WriteHeader(status)
+    if head {
+        if reply != nil {
+            reply.Abandon()
+        }
+        return
+    }
+
+    if format == format_json {
+        if single {
+            fmt.Fprintf(w, "{\"line\":%d,\"text\":", first)
+        } else {
+            fmt.Fprintf(w, "{\"from\":%d,\"to\":%d,\"lines\":[", first, first + count - 1)
+        }
+    }
+
+    var err error
+    escaper := &jsonEscaper{w: w}
+    for i := uint64(0); reply != nil && err == nil && (i < count || single && i == 0); i++ {
+        if i > 0 {
+            ok := false
+            if hdr, ok = <-reply.chunks; !ok {
+                hdr.err = io.ErrUnexpectedEOF
+            }
+            if err = hdr.err; err != nil {
+                break
+            }
+        }
+
+        if format == format_text {
+            if err = write_data(w, reply, hdr.size); err == nil {
+                _, err = io.WriteString(w, "\n")
+            }
+            continue
+        }
+
+        // Each chunk is escaped as it arrives, so a line is never gathered in memory
+        if i > 0 {
+            if _, err = io.WriteString(w, ","); err != nil {
+                break
+            }
+        }
+        if _, err = io.WriteString(w, "\""); err == nil {
+            err = write_data(escaper, reply, hdr.size)
+        }
+        if err == nil {
+            err = escaper.Close()
+        }
+    }
+
+    if err != nil {
+        state.opts.Logger.Println("HTTP write error: ", err)
+        reply.Abandon()
+        return
+    }
+    if format == format_json {
+        if single {
+            io.WriteString(w, "}\n")
+        } else {
+            io.WriteString(w, "]}\n")
+        }
+    }
+}
+
+//
+//  jsonEscaper object and methods - an io.Writer that writes the text written to it as the
+//  contents of a JSON string, a chunk at a time. A UTF-8 sequence split between two writes is held
+//  back until the rest of it arrives.
+//
+type jsonEscaper struct {
+    w       io.Writer
+    pending []byte  // The start of a UTF-8 sequence cut short by the last write
+    out     []byte  // Escaped text, reused from one write to the next
+}
+
+func (e *jsonEscaper) Write(p []byte) (int, error) {
+    n := len(p)
+    e.out = e.out[:0]
+
+    // Complete a sequence left over from the last write first
+    for len(e.pending) > 0 && len(p) > 0 && !utf8.FullRune(e.pending) {
+        e.pending = append(e.pending, p[0])
+        p = p[1:]
+    }
+    if len(e.pending) > 0 {
+        if !utf8.FullRune(e.pending) {
+            return n, nil
+        }
+        e.out = append_json(e.out, e.pending)
+        e.pending = e.pending[:0]
+    }
+
+    // Hold back a sequence cut short at the end of this write
+    tail := 0
+    for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+        if utf8.RuneStart(p[len(p) - i]) {
+            if !utf8.FullRune(p[len(p) - i:]) {
+                tail = i
+            }
+            break
+        }
+    }
+    e.out = append_json(e.out, p[:len(p) - tail])
+    e.pending = append(e.pending, p[len(p) - tail:]...)
+
+    _, err := e.w.Write(e.out)
+    return n, err
+}
+
+//
+// Method: Close
+//
+// Purpose: Ends the JSON string. A sequence still held back was never completed, and is written
+//          as U+FFFD. The jsonEscaper can then be used for another string.
+//
+func (e *jsonEscaper) Close() error {
+    e.out = append(append_json(e.out[:0], e.pending), '"')
+    e.pending = e.pending[:0]
+    _, err := e.w.Write(e.out)
+    return err
+}
+
+//
+// Function: append_json
+//
+// Purpose: Appends text to dst, escaped as the contents of a JSON string. Bytes that are not
+//          valid UTF-8 become U+FFFD; the text format returns lines byte for byte.
+//
+func append_json(dst []byte, text []byte) []byte {
+    const hex = "0123456789abcdef"
+    for len(text) > 0 {
+        r, size := utf8.DecodeRune(text)
+        switch {
+        case r == '"' || r == '\\':
+            dst = append(dst, '\\', byte(r))
+        case r == '\n':
+            dst = append(dst, '\\', 'n')
+        case r == '\r':
+            dst = append(dst, '\\', 'r')
+        case r == '\t':
+            dst = append(dst, '\\', 't')
+        case r < ' ':
+            dst = append(dst, '\\', 'u', '0', '0', hex[r >> 4], hex[r & 0xf])
+        case r == utf8.RuneError && size == 1:
+            dst = append(dst, `\ufffd`...)
+        case r == '\u2028' || r == '\u2029':
+            // Valid JSON, but not valid JavaScript
+            dst = append(dst, '\\', 'u', '2', '0', '2', hex[r & 0xf])
+        default:
+            dst = append(dst, text[:size]...)
+        }
+        text = text[size:]
+    }
+    return dst
+}
+
+//
+// Function: json_string
+//
+// Purpose: Encodes a line of text as a JSON string, as append_json does
+//
+func json_string(text []byte) []byte {
+    return append(append_json([]byte{'"'}, text), '"')
+}
+
+func set_content_type(w http.ResponseWriter, format string) {
+    if format == format_json {
+        w.Header().Set("Content-Type", "application/json")
+    } else {
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    }
+}
+
+//
+// Function: http_error
+//
+// Purpose: Writes an error response, as {"error": msg} in JSON
+//
+func http_error(w http.ResponseWriter, format string, status int, msg string) {
+    w.Header().Del("Content-Length")
+    set_content_type(w, format)
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(status)
+    if format == format_json {
+        fmt.Fprintf(w, "{\"error\":%s}\n", json_string([]byte(msg)))
+    } else {
+        io.WriteString(w, msg + "\n")
+    }
+}
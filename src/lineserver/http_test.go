@@ -0,0 +1,128 @@
+package lineserver
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestHttpGateway(t *testing.T) {
+    opts := test_options(t, Options{})
+    cfg := open_snapshot(write_source(t, "one\n  two  \nthree <&>\nfour\n\"five\"\n"), true, opts)
+    if cfg == nil {
+        t.Fatal("open_snapshot failed")
+    }
+    state := new_server_state(opts, cfg)
+    defer cfg.Release()
+    routes := http_routes(state)
+
+    cases := []struct {
+        method  string
+        target  string
+        header  string  // Range header, if any
+        status  int
+        body    string
+    }{
+        {"GET", "/lines/1", "", 200, "one\n"},
+        {"GET", "/lines/2", "", 200, "two\n"},
+        {"GET", "/lines/3?format=json", "", 200, "{\"line\":3,\"text\":\"three <&>\"}\n"},
+        {"GET", "/lines/0", "", 404, "line out of range\n"},
+        {"GET", "/lines/6?format=json", "", 404, "{\"error\":\"line out of range\"}\n"},
+        {"GET", "/lines/x", "", 400, "malformed line number: x\n"},
+        {"GET", "/lines", "", 200, "one\ntwo\nthree <&>\nfour\n\"five\"\n"},
+        {"GET", "/lines?from=2&to=3", "", 200, "two\nthree <&>\n"},
+        {"GET", "/lines?from=4&format=json", "", 200, "{\"from\":4,\"to\":5,\"lines\":[\"four\",\"\\\"five\\\"\"]}\n"},
+        {"GET", "/lines?to=1", "", 200, "one\n"},
+        {"GET", "/lines?from=6", "", 200, ""},
+        {"GET", "/lines?from=7", "", 404, "line out of range\n"},
+        {"GET", "/lines?from=2&to=9", "", 200, "two\nthree <&>\nfour\n\"five\"\n"},
+        {"GET", "/lines?from=1&to=999&format=json", "", 200, "{\"from\":1,\"to\":5,\"lines\":[\"one\",\"two\",\"three <&>\",\"four\",\"\\\"five\\\"\"]}\n"},
+        {"GET", "/lines?from=6&to=9", "", 200, ""},
+        {"GET", "/lines?from=7&to=9", "", 404, "line out of range\n"},
+        {"GET", "/lines?from=3&to=2", "", 400, "from 3 is past to 2\n"},
+        {"GET", "/lines?from=-1", "", 400, "malformed from: -1\n"},
+        {"GET", "/lines?from=0&to=2", "", 400, "malformed from: 0\n"},
+        {"GET", "/lines?to=0", "", 400, "malformed to: 0\n"},
+        {"GET", "/lines?format=xml", "", 400, "invalid format: xml\n"},
+        {"GET", "/lines", "lines=2-3", 206, "two\nthree <&>\n"},
+        {"GET", "/lines", "lines=4-", 206, "four\n\"five\"\n"},
+        {"GET", "/lines", "lines=-1", 206, "\"five\"\n"},
+        {"GET", "/lines", "lines=5-9", 206, "\"five\"\n"},
+        {"GET", "/lines", "lines=6-", 416, "range not satisfiable\n"},
+        {"GET", "/lines", "lines=0-1", 400, "malformed range: 0-1\n"},
+        {"GET", "/lines", "lines=1-2,4-5", 400, "multiple ranges are not supported: 1-2,4-5\n"},
+        {"GET", "/lines", "bytes=0-1", 200, "one\ntwo\nthree <&>\nfour\n\"five\"\n"},
+        {"GET", "/lines?from=1", "lines=1-2", 400, "Range can't be combined with from and to\n"},
+        {"POST", "/lines/1", "", 405, "method not allowed\n"},
+        {"HEAD", "/lines/1", "", 200, ""},
+        {"HEAD", "/lines/6", "", 404, "line out of range\n"},
+        {"HEAD", "/lines?format=json", "", 200, ""},
+        {"HEAD", "/lines", "lines=2-3", 206, ""},
+    }
+
+    for _, tc := range cases {
+        req := httptest.NewRequest(tc.method, tc.target, nil)
+        if tc.header != "" {
+            req.Header.Set("Range", tc.header)
+        }
+        rec := httptest.NewRecorder()
+        routes.ServeHTTP(rec, req)
+        if rec.Code != tc.status || rec.Body.String() != tc.body {
+            t.Errorf("%s %s %s: %d %q, want %d %q", tc.method, tc.target, tc.header, rec.Code, rec.Body.String(), tc.status, tc.body)
+        }
+    }
+
+    // Content-Range describes the lines served, out of the lines in the file
+    req := httptest.NewRequest("GET", "/lines", nil)
+    req.Header.Set("Range", "lines=-2")
+    rec := httptest.NewRecorder()
+    routes.ServeHTTP(rec, req)
+    if cr := rec.Header().Get("Content-Range"); cr != "lines 4-5/5" {
+        t.Errorf("Content-Range %q, want %q", cr, "lines 4-5/5")
+    }
+
+    // HEAD gets the headers GET would, without the body
+    rec = httptest.NewRecorder()
+    routes.ServeHTTP(rec, httptest.NewRequest("HEAD", "/lines/2", nil))
+    if cl := rec.Header().Get("Content-Length"); cl != "4" {
+        t.Errorf("HEAD /lines/2: Content-Length %q, want %q", cl, "4")
+    }
+
+    // Once shutdown has begun, requests are refused
+    state.InitiateShutdown()
+    rec = httptest.NewRecorder()
+    routes.ServeHTTP(rec, httptest.NewRequest("GET", "/lines/1", nil))
+    if rec.Code != http.StatusServiceUnavailable {
+        t.Errorf("GET /lines/1 during shutdown: %d, want %d", rec.Code, http.StatusServiceUnavailable)
+    }
+}
+
+func TestJSONEscaper(t *testing.T) {
+    text := []byte("quote \" backslash \\ tab \t nl \n ctl \x01 \u00e9\u20ac\U0001f600 sep \u2028 bad \xff\xe2\x82 end")
+
+    // The escaped text is the same wherever a write splits it, even mid-rune
+    whole := json_string(text)
+    for split := 0; split <= len(text); split++ {
+        var b bytes.Buffer
+        e := &jsonEscaper{w: &b}
+        b.WriteString("\"")
+        e.Write(text[:split])
+        e.Write(text[split:])
+        e.Close()
+        if !bytes.Equal(b.Bytes(), whole) {
+            t.Fatalf("split at %d: %s, want %s", split, b.Bytes(), whole)
+        }
+    }
+
+    var decoded string
+    if err := json.Unmarshal(whole, &decoded); err != nil {
+        t.Fatalf("%s: %v", whole, err)
+    }
+    want := strings.Replace(string(text), "\xff\xe2\x82", "\ufffd\ufffd\ufffd", 1)
+    if decoded != want {
+        t.Errorf("decoded %q, want %q", decoded, want)
+    }
+}
@@ -0,0 +1,311 @@
+package lineserver
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/fnv"
+    "io"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+//
+//  Index file layout:
+//
+//    +--------------------+  offset 0
+//    | IndexHeader        |  index_header_size bytes
+//    +--------------------+
+//    | {offset, length}   |  one index_record_size record per source line
+//    | ...                |
+//    +--------------------+
+//
+//  All values are little-endian. The header records enough about the source file to decide,
+//  at startup, whether an existing index can be reused instead of rebuilt.
+//
+const index_version uint32 = 1
+const index_record_size = 8 * 2         // uint64 tuple {offset, length}
+const index_header_size = 48            // binary.Size(IndexHeader{})
+const fingerprint_block = 64 * 1024     // Bytes hashed at each of the sampled source positions
+
+var index_magic = [8]byte{'L', 'S', 'I', 'N', 'D', 'E', 'X', 0}
+
+//
+//  IndexHeader object - fixed-length header at the start of every index file
+//
+type IndexHeader struct {
+    Magic       [8]byte
+    Version     uint32
+    RecordSize  uint32
+    SourceSize  uint64
+    SourceMtime int64   // Source modification time, in nanoseconds since the epoch
+    Fingerprint uint64  // FNV-1a hash of sampled source blocks; see source_fingerprint
+    Lines       uint64
+}
+
+//
+// Function: source_fingerprint
+//
+// Purpose: Computes a cheap content fingerprint of the source file by hashing its size and
+//          the blocks at its beginning, middle and end. Reading the whole file would defeat
+//          the purpose of reusing the index.
+//
+func source_fingerprint(src io.ReaderAt, size int64) (uint64, error) {
+    h := fnv.New64a()
+    binary.Write(h, binary.LittleEndian, size)
+
+    buffer := make([]byte, fingerprint_block)
+    for _, offset := range []int64{0, size / 2, size - fingerprint_block} {
+        if offset < 0 {
+            offset = 0
+        }
+        n, err := src.ReadAt(buffer, offset)
+        if err != nil && err != io.EOF {
+            return 0, err
+        }
+        h.Write(buffer[:n])
+    }
+
+    return h.Sum64(), nil
+}
+
+//
+// Function: source_header
+//
+// Purpose: Builds the index header that describes the current state of the source file
+//
+func source_header(src *os.File) (IndexHeader, error) {
+    var hdr IndexHeader
+
+    info, err := src.Stat()
+    if err != nil {
+        return hdr, err
+    }
+    fp, err := source_fingerprint(src, info.Size())
+    if err != nil {
+        return hdr, err
+    }
+
+    hdr.Magic = index_magic
+    hdr.Version = index_version
+    hdr.RecordSize = index_record_size
+    hdr.SourceSize = uint64(info.Size())
+    hdr.SourceMtime = info.ModTime().UnixNano()
+    hdr.Fingerprint = fp
+    return hdr, nil
+}
+
+//
+// Function: read_index_header
+//
+// Purpose: Reads and sanity checks the header of an existing index file
+//
+func read_index_header(index_file string) (IndexHeader, error) {
+    var hdr IndexHeader
+
+    idx, err := os.Open(index_file)
+    if err != nil {
+        return hdr, err
+    }
+    defer idx.Close()
+
+    if err := binary.Read(idx, binary.LittleEndian, &hdr); err != nil {
+        return hdr, err
+    }
+    if hdr.Magic != index_magic {
+        return hdr, errors.New("not an index file")
+    }
+    if hdr.Version != index_version || hdr.RecordSize != index_record_size {
+        return hdr, fmt.Errorf("unsupported index format version %d, record size %d", hdr.Version, hdr.RecordSize)
+    }
+
+    // A truncated index file must never be trusted
+    info, err := idx.Stat()
+    if err != nil {
+        return hdr, err
+    }
+    if info.Size() != index_header_size + int64(hdr.Lines) * index_record_size {
+        return hdr, fmt.Errorf("index file size %d does not match its line count %d", info.Size(), hdr.Lines)
+    }
+
+    return hdr, nil
+}
+
+//
+// Function: open_file_index
+//
+// Purpose: Returns the index file for the source file, and its header. An existing index is
+//          reused when its header matches the source file; otherwise the index is rebuilt.
+//
+func open_file_index(source_file string, rebuild bool, logger *log.Logger) (string, IndexHeader) {
+    index_file := source_file + ".idx"
+
+    src, err := os.Open(source_file)
+    if err != nil {
+        logger.Println(err)
+        return "", IndexHeader{}
+    }
+    want, err := source_header(src)
+    src.Close()
+    if err != nil {
+        logger.Println("Unable to fingerprint source file:", err)
+        return "", IndexHeader{}
+    }
+
+    if !rebuild {
+        have, err := read_index_header(index_file)
+        switch {
+        case err != nil:
+            logger.Printf("Index file '%s' is unusable: %s\n", index_file, err)
+        case have.SourceSize != want.SourceSize || have.SourceMtime != want.SourceMtime || have.Fingerprint != want.Fingerprint:
+            logger.Printf("Index file '%s' is stale\n", index_file)
+        default:
+            logger.Printf("Reusing index file '%s': %d lines\n", index_file, have.Lines)
+            return index_file, have
+        }
+    }
+
+    return create_file_index(source_file, logger)
+}
+
+//
+// Function: create_file_index
+//
+// Purpose: Create file index. The index is written to a temporary file and renamed into place
+//          once complete, so that an interrupted build never leaves a valid-looking index behind.
+//
+func create_file_index(source_file string, logger *log.Logger) (string, IndexHeader) {
+    // Open the source file
+    logger.Printf("Opening source file '%s'\n", source_file)
+    src, err := os.Open(source_file)
+    if err != nil {
+        logger.Println(err)
+        return "", IndexHeader{}
+    }
+    defer src.Close()
+
+    // Describe the source file before scanning it, so that a concurrent change is detected on the next start
+    hdr, err := source_header(src)
+    if err != nil {
+        logger.Println("Unable to fingerprint source file:", err)
+        return "", IndexHeader{}
+    }
+
+    // Create a temporary index file of its own, so that concurrent builds don't clobber each other
+    index_file := source_file + ".idx"
+    idx, err := ioutil.TempFile(filepath.Dir(index_file), filepath.Base(index_file) + ".*.tmp")
+    if err != nil {
+        logger.Println(err)
+        return "", IndexHeader{}
+    }
+    temp_file := idx.Name()
+    logger.Printf("Creating index file '%s'\n", temp_file)
+
+    built := false
+    defer func() {
+        idx.Close()
+        if !built {
+            os.Remove(temp_file)
+        }
+    }()
+
+    // Reserve space for the header; it is rewritten with the final line count below
+    w := bufio.NewWriterSize(idx, 64 * 1024)
+    if err := binary.Write(w, binary.LittleEndian, &hdr); err != nil {
+        logger.Println("binary.Write failed:", err)
+        return "", IndexHeader{}
+    }
+
+    // Find and mark line beginnings in the source file
+    var offset, lines uint64
+    var output [2]uint64
+    var eol, next, rollover, length int
+    var w_err error
+    var done bool
+
+    logger.Println("Searching source file for line endings...")
+
+    buffer := make([]byte, 4096)    // Typical Linux page size
+    for !done {
+
+        n, err := src.Read(buffer);
+        if err != nil {
+            if err == io.EOF {
+                break
+            }
+            logger.Println(err)
+            return "", IndexHeader{}
+        }
+
+        for s := string(buffer)[:n]; eol >= 0; {
+            eol = strings.IndexByte(s, '\n')
+            if eol >= 0 {
+                next = eol + 1  // String index of the start of the next line, relative to the current buffer
+                length = next + rollover   // Length of this string, in bytes. Includes any rollover from the previous buffer
+                rollover = 0
+
+                // Write index/size of line into index file
+                output[0] = offset
+                output[1]  = uint64(length)
+                w_err = binary.Write(w, binary.LittleEndian, output)
+                if w_err != nil {
+                    logger.Println("binary.Write failed:", w_err)
+                    return "", IndexHeader{}
+                }
+
+                offset += uint64(length)    // Offset is relative to the beginning of the file, in bytes
+                lines++
+                if next >= len(s) {
+                    break
+                }
+                s = s[next:]                // Slice the string so that it starts at the beginning of the next line
+            } else {
+                rollover += len(s)  // Accumulate the characters leftover in the previous buffer(s) (i.e., a partial line)
+            }
+        }
+        eol = 0
+    }
+
+    // The final line of the file need not end with a newline
+    if rollover > 0 {
+        output[0] = offset
+        output[1] = uint64(rollover)
+        if w_err = binary.Write(w, binary.LittleEndian, output); w_err != nil {
+            logger.Println("binary.Write failed:", w_err)
+            return "", IndexHeader{}
+        }
+        lines++
+    }
+
+    // Finalize the header and move the index into place
+    hdr.Lines = lines
+    if err := w.Flush(); err != nil {
+        logger.Println("Index write failed:", err)
+        return "", IndexHeader{}
+    }
+    if _, err := idx.Seek(0, io.SeekStart); err != nil {
+        logger.Println("Index Seek failed:", err)
+        return "", IndexHeader{}
+    }
+    if err := binary.Write(idx, binary.LittleEndian, &hdr); err != nil {
+        logger.Println("binary.Write failed:", err)
+        return "", IndexHeader{}
+    }
+    if err := idx.Sync(); err != nil {
+        logger.Println("Index sync failed:", err)
+        return "", IndexHeader{}
+    }
+    if err := os.Rename(temp_file, index_file); err != nil {
+        logger.Println(err)
+        return "", IndexHeader{}
+    }
+    built = true
+
+    logger.Printf("Indexed %d lines into '%s'\n", lines, index_file)
+
+    return index_file, hdr
+}
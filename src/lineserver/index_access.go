@@ -0,0 +1,189 @@
+package lineserver
+
+import (
+    "bufio"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "sync"
+    "sync/atomic"
+)
+
+const (
+    IndexAuto   = "auto"
+    IndexMemory = "memory"
+    IndexMmap   = "mmap"
+    IndexDisk   = "disk"
+)
+
+//
+//  Index interface - abstracts away how the {offset, length} record of a line is retrieved.
+//  Implementations must be safe for concurrent use by all zone owners. An index may also implement
+//  Extend, to grow in follow mode (see extendableIndex), and Kind, to be named by INFO.
+//
+type Index interface {
+    Lookup(line uint64) (offset uint64, length uint64, err error)
+    Close() error
+}
+
+//
+//  extendableIndex interface - an Index that can grow in place. In follow mode, Extend is called
+//  with the {offset, length} records of the lines from line first onwards, once they are in the
+//  index file. Line first is either the next line, or a partial last line that has grown. A source
+//  file served through an index without Extend is reindexed in full when lines are appended.
+//
+type extendableIndex interface {
+    Index
+    Extend(first uint64, records []uint64) error
+}
+
+//
+// Function: index_kind
+//
+// Purpose: Names the backend of an index, for INFO: "custom" for an index that doesn't say
+//
+func index_kind(index Index) string {
+    if k, ok := index.(interface{ Kind() string }); ok {
+        return k.Kind()
+    }
+    return "custom"
+}
+
+//
+//  memoryIndex object and methods - the whole index table is held in RAM
+//
+type memoryIndex struct {
+    lock  *sync.RWMutex
+    table []uint64  // {offset, length} pairs, one per line
+}
+
+func (m *memoryIndex) Lookup(line uint64) (uint64, uint64, error) {
+    m.lock.RLock()
+    defer m.lock.RUnlock()
+
+    if line < 1 || line > uint64(len(m.table) / 2) {
+        return 0, 0, fmt.Errorf("line %d is not in the index", line)
+    }
+    i := (line - 1) * 2
+    return m.table[i], m.table[i + 1], nil
+}
+
+func (m *memoryIndex) Extend(first uint64, records []uint64) error {
+    m.lock.Lock()
+    m.table = append(m.table[:(first - 1) * 2], records...)
+    m.lock.Unlock()
+    return nil
+}
+
+func (m *memoryIndex) Kind() string {
+    return IndexMemory
+}
+
+func (m *memoryIndex) Close() error {
+    m.table = nil
+    return nil
+}
+
+//
+//  diskIndex object and methods - every lookup reads the record from the index file, with a
+//  positional read on the shared file handle
+//
+type diskIndex struct {
+    idx   *os.File
+    lines uint64    // Updated atomically
+}
+
+func (d *diskIndex) Lookup(line uint64) (uint64, uint64, error) {
+    if line < 1 || line > atomic.LoadUint64(&d.lines) {
+        return 0, 0, fmt.Errorf("line %d is not in the index", line)
+    }
+
+    var record [index_record_size]byte
+
+    // Retrieve the offset and length of the requested line
+    if err := read_at(d.idx, record[:], index_header_size + (line - 1) * index_record_size); err != nil {
+        return 0, 0, err
+    }
+    return binary.LittleEndian.Uint64(record[0:8]), binary.LittleEndian.Uint64(record[8:16]), nil
+}
+
+func (d *diskIndex) Extend(first uint64, records []uint64) error {
+    atomic.StoreUint64(&d.lines, first - 1 + uint64(len(records) / 2))
+    return nil
+}
+
+func (d *diskIndex) Kind() string {
+    return IndexDisk
+}
+
+func (d *diskIndex) Close() error {
+    return d.idx.Close()
+}
+
+//
+// Function: select_index_mode
+//
+// Purpose: Resolves the "auto" index mode against the memory budget: keep the index in memory
+//          when it fits, otherwise memory-map it, otherwise read it from disk.
+//
+func select_index_mode(mode string, lines uint64, budget uint64) string {
+    if mode != IndexAuto {
+        return mode
+    }
+    if lines * index_record_size <= budget {
+        return IndexMemory
+    }
+    if mmap_supported {
+        return IndexMmap
+    }
+    return IndexDisk
+}
+
+//
+// Function: open_line_index
+//
+// Purpose: Opens the index file using the requested access mode
+//
+func open_line_index(index_file string, lines uint64, mode string, budget uint64, logger *log.Logger) (Index, error) {
+    mode = select_index_mode(mode, lines, budget)
+    logger.Printf("Opening index file '%s' in %s mode\n", index_file, mode)
+
+    switch mode {
+    case IndexMemory:
+        return load_memory_index(index_file, lines)
+    case IndexMmap:
+        return open_mmap_index(index_file, lines)
+    case IndexDisk:
+        idx, err := os.Open(index_file)
+        if err != nil {
+            return nil, err
+        }
+        return &diskIndex{idx, lines}, nil
+    }
+    return nil, fmt.Errorf("unknown index mode '%s'", mode)
+}
+
+//
+// Function: load_memory_index
+//
+// Purpose: Reads the complete index table into memory
+//
+func load_memory_index(index_file string, lines uint64) (*memoryIndex, error) {
+    idx, err := os.Open(index_file)
+    if err != nil {
+        return nil, err
+    }
+    defer idx.Close()
+
+    if _, err := idx.Seek(index_header_size, io.SeekStart); err != nil {
+        return nil, err
+    }
+
+    table := make([]uint64, lines * 2)
+    if err := binary.Read(bufio.NewReaderSize(idx, 64 * 1024), binary.LittleEndian, table); err != nil {
+        return nil, err
+    }
+    return &memoryIndex{new(sync.RWMutex), table}, nil
+}
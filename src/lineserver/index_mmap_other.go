@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package lineserver
+
+import (
+    "errors"
+)
+
+const mmap_supported = false
+
+//
+// Function: open_mmap_index
+//
+// Purpose: Memory-mapped index files are not supported on this platform
+//
+func open_mmap_index(index_file string, lines uint64) (Index, error) {
+    return nil, errors.New("memory-mapped index files are not supported on this platform")
+}
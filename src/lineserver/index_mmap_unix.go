@@ -0,0 +1,93 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package lineserver
+
+import (
+    "encoding/binary"
+    "fmt"
+    "os"
+    "sync"
+    "syscall"
+)
+
+const mmap_supported = true
+
+//
+//  mmapIndex object and methods - the index file is memory-mapped, and paged in by the OS on demand
+//
+type mmapIndex struct {
+    lock  *sync.RWMutex     // Held for writing while the mapping is replaced by Extend
+    idx   *os.File          // Kept open, so that the mapping can be extended in follow mode
+    data  []byte
+    lines uint64
+}
+
+func (m *mmapIndex) Lookup(line uint64) (uint64, uint64, error) {
+    m.lock.RLock()
+    defer m.lock.RUnlock()
+
+    if line < 1 || line > m.lines {
+        return 0, 0, fmt.Errorf("line %d is not in the index", line)
+    }
+    record := m.data[index_header_size + (line - 1) * index_record_size:]
+    return binary.LittleEndian.Uint64(record[0:8]), binary.LittleEndian.Uint64(record[8:16]), nil
+}
+
+//
+// Method: Extend
+//
+// Purpose: Replaces the mapping with one that also covers the newly appended records
+//
+func (m *mmapIndex) Extend(first uint64, records []uint64) error {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    lines := first - 1 + uint64(len(records) / 2)
+    data, err := map_index(m.idx, lines)
+    if err != nil {
+        return err
+    }
+    syscall.Munmap(m.data)
+    m.data = data
+    m.lines = lines
+    return nil
+}
+
+func (m *mmapIndex) Kind() string {
+    return IndexMmap
+}
+
+func (m *mmapIndex) Close() error {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    data := m.data
+    m.data = nil
+    m.idx.Close()
+    return syscall.Munmap(data)
+}
+
+//
+// Function: open_mmap_index
+//
+// Purpose: Memory-maps the index file, read-only
+//
+func open_mmap_index(index_file string, lines uint64) (Index, error) {
+    idx, err := os.Open(index_file)
+    if err != nil {
+        return nil, err
+    }
+
+    data, err := map_index(idx, lines)
+    if err != nil {
+        idx.Close()
+        return nil, err
+    }
+    return &mmapIndex{new(sync.RWMutex), idx, data, lines}, nil
+}
+
+func map_index(idx *os.File, lines uint64) ([]byte, error) {
+    size := index_header_size + int64(lines) * index_record_size
+    return syscall.Mmap(int(idx.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
@@ -0,0 +1,467 @@
+package lineserver
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+)
+
+//
+//  Generated source files covering the edge cases of the index scan, which reads the source file
+//  in 4096 byte buffers
+//
+var index_cases = []struct {
+    name    string
+    content string
+}{
+    {"empty", ""},
+    {"only newlines", "\n\n\n"},
+    {"single newline", "\n"},
+    {"single line without newline", "abc"},
+    {"no final newline", "one\ntwo\nthree"},
+    {"crlf", "one\r\ntwo\r\n\r\nthree\r\n"},
+    {"whitespace", "  lead\ntrail \t\n\t\n"},
+    {"whitespace only lines", " \n\t\t\n \r\n\v\f\n  "},
+    {"bare carriage returns", "a\rb\r\n\r\r\n\r"},
+    {"line ends at buffer end", make_line(4096, 'a') + "next\n"},
+    {"line ends before buffer end", make_line(4095, 'a') + "next\n"},
+    {"line ends after buffer end", make_line(4097, 'a') + "next\n"},
+    {"newline starts next buffer", strings.Repeat("a", 4096) + "\nnext\n"},
+    {"line straddles boundary", "short\n" + make_line(4100, 'b') + "short\n"},
+    {"line spans three buffers", "short\n" + make_line(3 * 4096 + 7, 'c') + "short\n"},
+    {"line spans many buffers", make_line(10 * 4096, 'd') + make_line(5, 'e') + make_line(20000, 'f')},
+    {"long partial last line", "short\n" + strings.Repeat("g", 9000)},
+    {"many short lines", strings.Repeat(make_line(7, 'h'), 3000)},
+    {"many short lines, no final newline", strings.Repeat(make_line(13, 'i'), 1000) + "tail"},
+}
+
+//
+// Function: make_line
+//
+// Purpose: Returns a line of length bytes, including its newline
+//
+func make_line(length int, c byte) string {
+    return strings.Repeat(string(c), length - 1) + "\n"
+}
+
+//
+// Function: expected_records
+//
+// Purpose: Splits content into lines the simple way, as {offset, length} records. The final line
+//          need not end with a newline.
+//
+func expected_records(content string) []uint64 {
+    var records []uint64
+    var offset uint64
+    for _, line := range strings.SplitAfter(content, "\n") {
+        if line == "" {
+            continue
+        }
+        records = append(records, offset, uint64(len(line)))
+        offset += uint64(len(line))
+    }
+    return records
+}
+
+//
+// Function: strip_terminator
+//
+// Purpose: Returns a line without its LF or CRLF, as GET returns it in exact mode
+//
+func strip_terminator(line string) string {
+    if strings.HasSuffix(line, "\r\n") {
+        return line[:len(line) - 2]
+    }
+    return strings.TrimSuffix(line, "\n")
+}
+
+//
+// Function: test_options
+//
+// Purpose: Returns the default options, with the given changes
+//
+func test_options(t *testing.T, opts Options) *Options {
+    t.Helper()
+    if err := opts.validate(); err != nil {
+        t.Fatal(err)
+    }
+    return &opts
+}
+
+//
+// Function: write_source
+//
+// Purpose: Writes a generated source file into a temporary directory, and returns its name
+//
+func write_source(t *testing.T, content string) string {
+    source_file := filepath.Join(t.TempDir(), "source.txt")
+    if err := ioutil.WriteFile(source_file, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    return source_file
+}
+
+func TestCreateFileIndex(t *testing.T) {
+    for _, tc := range index_cases {
+        t.Run(tc.name, func(t *testing.T) {
+            source_file := write_source(t, tc.content)
+            want := expected_records(tc.content)
+
+            index_file, hdr := create_file_index(source_file, test_options(t, Options{}).Logger)
+            if index_file == "" {
+                t.Fatal("create_file_index failed")
+            }
+            if hdr.Lines != uint64(len(want) / 2) {
+                t.Fatalf("indexed %d lines, want %d", hdr.Lines, len(want) / 2)
+            }
+            if hdr.SourceSize != uint64(len(tc.content)) {
+                t.Errorf("source size %d, want %d", hdr.SourceSize, len(tc.content))
+            }
+
+            if _, err := read_index_header(index_file); err != nil {
+                t.Fatalf("index header: %s", err)
+            }
+            index, err := load_memory_index(index_file, hdr.Lines)
+            if err != nil {
+                t.Fatal(err)
+            }
+            for i := 0; i < len(want); i += 2 {
+                offset, length, err := index.Lookup(uint64(i / 2 + 1))
+                if err != nil || offset != want[i] || length != want[i + 1] {
+                    t.Fatalf("line %d: {%d, %d} %v, want {%d, %d}", i / 2 + 1, offset, length, err, want[i], want[i + 1])
+                }
+            }
+        })
+    }
+}
+
+func TestCreateFileIndexConcurrently(t *testing.T) {
+    content := generate_source(7, 20000)
+    source_file := write_source(t, content)
+    logger := test_options(t, Options{}).Logger
+
+    // Concurrent builds for the same file each write their own temporary file
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if index_file, _ := create_file_index(source_file, logger); index_file == "" {
+                t.Error("create_file_index failed")
+            }
+        }()
+    }
+    wg.Wait()
+
+    // Whichever build was renamed into place last, the index is whole, and no temporary file is left
+    hdr, err := read_index_header(source_file + ".idx")
+    if err != nil {
+        t.Fatal(err)
+    }
+    index, err := load_memory_index(source_file + ".idx", hdr.Lines)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := expected_records(content); !reflect.DeepEqual(index.table, want) {
+        t.Fatal("index doesn't match the source file")
+    }
+    if temps, _ := filepath.Glob(source_file + ".idx.*.tmp"); len(temps) != 0 {
+        t.Errorf("temporary files left behind: %v", temps)
+    }
+}
+
+//
+// Function: patch_file
+//
+// Purpose: Overwrites the bytes of a file at offset, keeping its size
+//
+func patch_file(t *testing.T, file string, offset int64, b []byte) {
+    t.Helper()
+    f, err := os.OpenFile(file, os.O_WRONLY, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    if _, err := f.WriteAt(b, offset); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestOpenFileIndex(t *testing.T) {
+    const content = "one\ntwo\nthree\n"
+    cases := []struct {
+        name   string
+        alter  func(t *testing.T, source_file string, index_file string)
+        header bool     // read_index_header still accepts the altered index
+        reused bool
+    }{
+        {"unchanged", func(t *testing.T, source_file string, index_file string) {}, true, true},
+        {"source rewritten", func(t *testing.T, source_file string, index_file string) {
+            // Same size and modification time, different content
+            info, err := os.Stat(source_file)
+            if err != nil {
+                t.Fatal(err)
+            }
+            patch_file(t, source_file, 0, []byte("ONE"))
+            if err := os.Chtimes(source_file, info.ModTime(), info.ModTime()); err != nil {
+                t.Fatal(err)
+            }
+        }, true, false},
+        {"wrong magic", func(t *testing.T, source_file string, index_file string) {
+            patch_file(t, index_file, 0, []byte("X"))
+        }, false, false},
+        {"wrong version", func(t *testing.T, source_file string, index_file string) {
+            patch_file(t, index_file, 8, []byte{byte(index_version + 1)})
+        }, false, false},
+        {"truncated", func(t *testing.T, source_file string, index_file string) {
+            info, err := os.Stat(index_file)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if err := os.Truncate(index_file, info.Size() - 1); err != nil {
+                t.Fatal(err)
+            }
+        }, false, false},
+        {"header only", func(t *testing.T, source_file string, index_file string) {
+            if err := os.Truncate(index_file, index_header_size - 1); err != nil {
+                t.Fatal(err)
+            }
+        }, false, false},
+    }
+
+    logger := test_options(t, Options{}).Logger
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            source_file := write_source(t, content)
+            index_file, _ := open_file_index(source_file, true, logger)
+            if index_file == "" {
+                t.Fatal("open_file_index failed")
+            }
+
+            tc.alter(t, source_file, index_file)
+            if _, err := read_index_header(index_file); (err == nil) != tc.header {
+                t.Errorf("read_index_header returned %v, want success %t", err, tc.header)
+            }
+            before, err := os.Stat(index_file)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            // A rebuilt index replaces the old file; a reused one is the same file
+            reopened, hdr := open_file_index(source_file, false, logger)
+            if reopened != index_file {
+                t.Fatalf("reopened '%s', want '%s'", reopened, index_file)
+            }
+            after, err := os.Stat(index_file)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if reused := os.SameFile(before, after); reused != tc.reused {
+                t.Errorf("index reused %t, want %t", reused, tc.reused)
+            }
+
+            // Either way, the index now describes the source file
+            if hdr.Lines != 3 {
+                t.Errorf("%d lines, want 3", hdr.Lines)
+            }
+            if _, err := read_index_header(index_file); err != nil {
+                t.Errorf("index header: %s", err)
+            }
+        })
+    }
+}
+
+func TestScanLines(t *testing.T) {
+    for _, tc := range index_cases {
+        t.Run(tc.name, func(t *testing.T) {
+            want := expected_records(tc.content)
+            var have []uint64
+            err := scan_lines(strings.NewReader(tc.content), 0, uint64(len(tc.content)), func(records []uint64) error {
+                have = append(have, records...)
+                return nil
+            })
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(have) != len(want) {
+                t.Fatalf("scanned %d lines, want %d", len(have) / 2, len(want) / 2)
+            }
+            for i := range want {
+                if have[i] != want[i] {
+                    t.Fatalf("line %d: {%d, %d}, want {%d, %d}", i / 2 + 1, have[i &^ 1], have[i | 1], want[i &^ 1], want[i | 1])
+                }
+            }
+        })
+    }
+}
+
+//
+// Function: index_modes
+//
+// Purpose: Returns the index access modes supported on this platform
+//
+func index_modes() []string {
+    if mmap_supported {
+        return []string{IndexMemory, IndexMmap, IndexDisk}
+    }
+    return []string{IndexMemory, IndexDisk}
+}
+
+func TestGetEveryLine(t *testing.T) {
+    for _, mode := range index_modes() {
+        for _, tc := range index_cases {
+            t.Run(mode + "/" + tc.name, func(t *testing.T) {
+                cfg := open_snapshot(write_source(t, tc.content), true, test_options(t, Options{IndexMode: mode}))
+                if cfg == nil {
+                    t.Fatal("open_snapshot failed")
+                }
+                defer cfg.Release()
+                if kind := index_kind(cfg.zones.store.index); kind != mode {
+                    t.Fatalf("%s index, want %s", kind, mode)
+                }
+
+                lines := expected_records(tc.content)
+                for i := 0; i < len(lines); i += 2 {
+                    line := uint64(i / 2 + 1)
+                    text := strings.TrimSpace(tc.content[lines[i]:lines[i] + lines[i + 1]])
+                    expect_reply(t, cfg.zones, line, "OK\r\n" + text + "\r\n")
+                }
+                expect_reply(t, cfg.zones, 0, "ERR\r\n")
+                expect_reply(t, cfg.zones, uint64(len(lines) / 2 + 1), "ERR\r\n")
+            })
+        }
+    }
+}
+
+func TestSelectIndexMode(t *testing.T) {
+    over_budget := IndexMmap
+    if !mmap_supported {
+        over_budget = IndexDisk
+    }
+    cases := []struct {
+        mode   string
+        lines  uint64
+        budget uint64
+        want   string
+    }{
+        {IndexAuto, 0, 0, IndexMemory},
+        {IndexAuto, 64, 64 * index_record_size, IndexMemory},
+        {IndexAuto, 65, 64 * index_record_size, over_budget},
+        {IndexAuto, 1 << 40, 256 * 1024 * 1024, over_budget},
+        {IndexMemory, 1 << 40, 0, IndexMemory},
+        {IndexMmap, 1, 1 << 30, IndexMmap},
+        {IndexDisk, 1, 1 << 30, IndexDisk},
+    }
+    for _, tc := range cases {
+        if have := select_index_mode(tc.mode, tc.lines, tc.budget); have != tc.want {
+            t.Errorf("%s, %d lines, budget %d: %s, want %s", tc.mode, tc.lines, tc.budget, have, tc.want)
+        }
+    }
+}
+
+func TestTrimUnicode(t *testing.T) {
+    // Trimmed as by strings.TrimSpace, whatever the chunk size, even where a rune straddles chunks
+    for _, line := range []string{
+        "\u00a0x\u00a0",
+        "\u3000\u0085 two words\t\u2028\r\n",
+        " \u00a0\u3000\u00a0 \n",
+        "\u00a0\xff\u00a0",
+        "\xe3\x80\u3000",
+        "\u3000\xe3\x80",
+        "x\xa0\xa0",
+        "\u00a0\u00a0\u00a0\u00a0\u00a0\u00a0\u00a0\u00a0\u00a0",
+        "\U0001F600 \u205f",
+    } {
+        want := strings.TrimSpace(line)
+        for size := 1; size <= 10; size++ {
+            offset, length, err := trim_range(strings.NewReader(line), make([]byte, size), 0, uint64(len(line)), TrimSpace)
+            if got := line[offset:offset + length]; err != nil || got != want {
+                t.Errorf("%q with %d-byte chunks: %q %v, want %q", line, size, got, err, want)
+            }
+        }
+        if got := string(trim_bytes([]byte(line), TrimSpace)); got != want {
+            t.Errorf("%q in memory: %q, want %q", line, got, want)
+        }
+    }
+}
+
+func TestExactTinyChunks(t *testing.T) {
+    // A chunk smaller than a CR-LF still serves every line
+    for _, size := range []int{1, 2, 3} {
+        for _, tc := range index_cases {
+            cfg := open_snapshot(write_source(t, tc.content), true, test_options(t, Options{TrimMode: TrimExact, ChunkSize: size}))
+            if cfg == nil {
+                t.Fatal("open_snapshot failed")
+            }
+            lines := expected_records(tc.content)
+            for i := 0; i < len(lines); i += 2 {
+                text := strip_terminator(tc.content[lines[i]:lines[i] + lines[i + 1]])
+                expect_reply(t, cfg.zones, uint64(i / 2 + 1), "OK\r\n" + text + "\r\n")
+            }
+            cfg.Release()
+        }
+    }
+}
+
+func TestGetExactLines(t *testing.T) {
+    for _, tc := range index_cases {
+        t.Run(tc.name, func(t *testing.T) {
+            cfg := open_snapshot(write_source(t, tc.content), true, test_options(t, Options{TrimMode: TrimExact}))
+            if cfg == nil {
+                t.Fatal("open_snapshot failed")
+            }
+            defer cfg.Release()
+
+            lines := expected_records(tc.content)
+            for i := 0; i < len(lines); i += 2 {
+                text := strip_terminator(tc.content[lines[i]:lines[i] + lines[i + 1]])
+                expect_reply(t, cfg.zones, uint64(i / 2 + 1), "OK\r\n" + text + "\r\n")
+            }
+
+            // Ranges are read sequentially, rather than line by line
+            if count := uint64(len(lines) / 2); count > 0 {
+                var out bytes.Buffer
+                if err := write_range(&out, cfg.zones, 1, count, framing_line); err != nil {
+                    t.Fatal(err)
+                }
+                want := fmt.Sprintf("OK %d\r\n", count)
+                for i := 0; i < len(lines); i += 2 {
+                    want += strip_terminator(tc.content[lines[i]:lines[i] + lines[i + 1]]) + "\r\n"
+                }
+                if out.String() != want {
+                    t.Fatalf("GET 1-%d: %q, want %q", count, abbreviate(out.String()), abbreviate(want))
+                }
+            }
+        })
+    }
+}
+
+//
+// Function: expect_reply
+//
+// Purpose: Retrieves a line as the client handler does for GET, and checks the response
+//
+func expect_reply(t *testing.T, zones *zoneSet, line uint64, want string) {
+    t.Helper()
+
+    var out bytes.Buffer
+    if err := write_text(&out, zones.Get(line), framing_line); err != nil {
+        t.Fatalf("GET %d: %s", line, err)
+    }
+    if out.String() != want {
+        t.Fatalf("GET %d: %q, want %q", line, abbreviate(out.String()), abbreviate(want))
+    }
+}
+
+func abbreviate(s string) string {
+    if len(s) > 64 {
+        return s[:30] + "..." + s[len(s) - 30:]
+    }
+    return s
+}
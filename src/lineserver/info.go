@@ -0,0 +1,72 @@
+package lineserver
+
+import (
+    "fmt"
+    "io"
+    "time"
+)
+
+const server_version = "1.1.0"
+
+//
+// Function: stat_line
+//
+// Purpose: Describes the revision of the source file being served, in one line. Clients can
+//          compare it between connections to detect that the served file has changed.
+//
+func stat_line(store *lineStore) string {
+    hdr := store.GetHeader()
+    return fmt.Sprintf("lines=%d size=%d mtime=%d fingerprint=%016x",
+        store.GetLines(), hdr.SourceSize, hdr.SourceMtime, hdr.Fingerprint)
+}
+
+//
+//  infoField object - one field of the server metadata reported by INFO
+//
+type infoField struct {
+    name  string
+    value interface{}
+}
+
+//
+// Function: info_fields
+//
+// Purpose: Collects the server metadata reported by INFO
+//
+func info_fields(state *serverState, zones *zoneSet) []infoField {
+    store := zones.store
+    hdr := store.GetHeader()
+    return []infoField{
+        {"version", server_version},
+        {"uptime_seconds", int64(time.Since(state.started) / time.Second)},
+        {"lines", store.GetLines()},
+        {"source_size", hdr.SourceSize},
+        {"source_mtime", time.Unix(0, hdr.SourceMtime).UTC().Format(time.RFC3339Nano)},
+        {"source_fingerprint", fmt.Sprintf("%016x", hdr.Fingerprint)},
+        {"index_format", hdr.Version},
+        {"index_backend", index_kind(store.index)},
+        {"zones", zones.Count()},
+        {"clients_connected", state.clients.Active()},
+        {"clients_peak", state.clients.Peak()},
+        {"clients_total", state.clients.Total()},
+    }
+}
+
+//
+// Function: write_info
+//
+// Purpose: Writes the INFO response: an "OK <count>" header followed by one "name: value" line
+//          per field
+//
+func write_info(w io.Writer, state *serverState, zones *zoneSet) error {
+    fields := info_fields(state, zones)
+    if _, err := fmt.Fprintf(w, "OK %d\r\n", len(fields)); err != nil {
+        return err
+    }
+    for _, field := range fields {
+        if _, err := fmt.Fprintf(w, "%s: %v\r\n", field.name, field.value); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,224 @@
+package lineserver
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+//
+//  Memcached ASCII protocol compatibility. Each line number is a key: "get <n> [<n> ...]" returns
+//  a VALUE block per line found, and "gets" adds a cas unique (the revision of the source file),
+//  so that legacy memcached clients can read lines. The server is read-only.
+//
+const memcache_max_key = 250    // Longest key memcached accepts
+const memcache_max_line = 8 * 1024  // Most bytes in one command line, terminator included
+
+var memcache_protocol = &protocol{"memcache", memcache_handler, []byte("SERVER_ERROR Too many open connections\r\n")}
+
+var errMemcacheTooLong = errors.New("line too long")
+
+//
+// Function: read_memcache_line
+//
+// Purpose: Reads one command line, with its terminator. A line of more than memcache_max_line
+//          bytes fails with errMemcacheTooLong, before the rest of it is read.
+//
+func read_memcache_line(reader *bufio.Reader) (string, error) {
+    var line []byte
+    for {
+        part, err := reader.ReadSlice('\n')
+        if len(line) + len(part) > memcache_max_line {
+            return "", errMemcacheTooLong
+        }
+        line = append(line, part...)
+        if err != bufio.ErrBufferFull {
+            return string(line), err
+        }
+    }
+}
+
+//
+// Function: write_values
+//
+// Purpose: Writes the lines named by keys as VALUE blocks, in request order, followed by END.
+//          Keys that are not the numbers of lines in the file are left out.
+//
+func write_values(w io.Writer, state *serverState, zones *zoneSet, keys []string, cas bool) error {
+    lines := make([]uint64, len(keys))
+    for i, key := range keys {
+        lines[i] = parse_key(key)
+    }
+    unique := zones.store.GetHeader().Fingerprint
+
+    err := write_window(zones, lines, func(i int, reply *textReply, hdr chunk, ok bool) error {
+        return write_value(w, state, keys[i], reply, hdr, ok, cas, unique)
+    })
+    if err == nil {
+        _, err = io.WriteString(w, "END\r\n")
+    }
+    return err
+}
+
+//
+// Function: write_value
+//
+// Purpose: Writes one line as a VALUE block, given the header chunk already received from its
+//          reply, or nothing if the line could not be retrieved
+//
+func write_value(w io.Writer, state *serverState, key string, reply *textReply, hdr chunk, ok bool, cas bool, unique uint64) error {
+    atomic.AddUint64(&state.cmd_get, 1)
+
+    if !ok || hdr.err != nil {
+        reply.Abandon()
+        atomic.AddUint64(&state.get_misses, 1)
+        return nil
+    }
+    atomic.AddUint64(&state.get_hits, 1)
+
+    var err error
+    if cas {
+        _, err = fmt.Fprintf(w, "VALUE %s 0 %d %d\r\n", key, hdr.size, unique)
+    } else {
+        _, err = fmt.Fprintf(w, "VALUE %s 0 %d\r\n", key, hdr.size)
+    }
+    if err == nil {
+        err = write_body(w, reply, hdr.size)
+    }
+    if err != nil {
+        reply.Abandon()
+    }
+    return err
+}
+
+//
+// Function: write_stats
+//
+// Purpose: Writes the response to stats: a "STAT <name> <value>" line per statistic, then END
+//
+func write_stats(w io.Writer, state *serverState, zones *zoneSet) error {
+    now := time.Now()
+    stats := []infoField{
+        {"pid", os.Getpid()},
+        {"uptime", int64(now.Sub(state.started) / time.Second)},
+        {"time", now.Unix()},
+        {"version", server_version},
+        {"curr_connections", state.clients.Active()},
+        {"max_connections", state.opts.MaxClients},
+        {"total_connections", state.clients.Total()},
+        {"curr_items", zones.store.GetLines()},
+        {"bytes", zones.store.GetHeader().SourceSize},
+        {"cmd_get", atomic.LoadUint64(&state.cmd_get)},
+        {"get_hits", atomic.LoadUint64(&state.get_hits)},
+        {"get_misses", atomic.LoadUint64(&state.get_misses)},
+    }
+    for _, stat := range stats {
+        if _, err := fmt.Fprintf(w, "STAT %s %v\r\n", stat.name, stat.value); err != nil {
+            return err
+        }
+    }
+    _, err := io.WriteString(w, "END\r\n")
+    return err
+}
+
+//
+// GoRoutine: memcache_handler
+//
+// Purpose: Validates and executes the commands of a memcached client, as client_handler does for
+//          the text protocol
+//
+func memcache_handler(client net.Conn, idle time.Duration, state *serverState, admin bool) {
+    state.Track(client)
+    cfg := state.Acquire()  // This connection is served from the same snapshot until it closes
+    zones := cfg.zones
+
+    // client handler closure
+    defer func() {
+        state.opts.Logger.Printf("Closing socket to %s\n", client.RemoteAddr().String())
+        cfg.Release()
+        state.Untrack(client)
+        client.Close()
+        state.clients.Release(admin)
+        state.Done()
+    }()
+
+    reader := bufio.NewReader(client)
+    writer := bufio.NewWriter(&stallConn{client, state.opts.WriteTimeout})  // A client that stops reading is disconnected
+    done := false
+
+    for !done {
+        // Set idle timeout; at shutdown, the wait is cut short by Drain
+        state.SetIdleDeadline(client, idle)
+
+        msg, err := read_memcache_line(reader)
+        if err == errMemcacheTooLong {
+            // The rest of the line can't be told from the next command
+            writer.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+            writer.Flush()
+            break
+        }
+        if err != nil {
+            if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+                if state.IsShutdown() {
+                    state.opts.Logger.Println("Client received shutdown signal")
+                } else {
+                    state.opts.Logger.Println("Client idle timeout")
+                }
+            } else if err != io.EOF {
+                state.opts.Logger.Println("Client read error: ", err)
+            }
+            break
+        }
+
+        args := strings.Fields(msg)
+        if len(args) == 0 {
+            writer.WriteString("ERROR\r\n")
+            writer.Flush()
+            continue
+        }
+        state.opts.Logger.Println("Command: " + strings.TrimSpace(msg))
+
+        var err2 error
+        switch cmd := args[0]; cmd {
+        case "get", "gets":     // get <key>*
+            if len(args) < 2 {
+                _, err2 = writer.WriteString("ERROR\r\n")
+                break
+            }
+            long := false
+            for _, key := range args[1:] {
+                long = long || len(key) > memcache_max_key
+            }
+            if long {
+                _, err2 = writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+                break
+            }
+            err2 = write_values(writer, state, zones, args[1:], cmd == "gets")
+        case "stats":
+            if len(args) > 1 {
+                _, err2 = writer.WriteString("END\r\n")     // No sub-statistics (items, slabs, ...)
+                break
+            }
+            err2 = write_stats(writer, state, zones)
+        case "version":
+            _, err2 = writer.WriteString("VERSION " + server_version + "\r\n")
+        case "quit":
+            done = true
+        default:
+            _, err2 = writer.WriteString("ERROR\r\n")
+        }
+        if err2 == nil {
+            err2 = writer.Flush()
+        }
+        if err2 != nil {
+            state.opts.Logger.Println("Client write error: ", err2)
+            done = true
+        }
+    }
+}
@@ -0,0 +1,78 @@
+package lineserver
+
+import (
+    "fmt"
+    "io/ioutil"
+    "strings"
+    "testing"
+)
+
+func TestMemcacheCommands(t *testing.T) {
+    client, cfg := start_handler(t, "one\n  two  \n" + long_line + "\n\n", memcache_handler)
+
+    long := strings.TrimSpace(long_line)
+    unique := cfg.zones.store.GetHeader().Fingerprint
+    requests := []struct {
+        req  string
+        want string
+    }{
+        {"get 1\r\n", "VALUE 1 0 3\r\none\r\nEND\r\n"},
+        {"get 2 9 x 4 3\r\n", "VALUE 2 0 3\r\ntwo\r\nVALUE 4 0 0\r\n\r\n" + fmt.Sprintf("VALUE 3 0 %d\r\n%s\r\n", len(long), long) + "END\r\n"},
+        {"gets 1\r\n", fmt.Sprintf("VALUE 1 0 3 %d\r\none\r\nEND\r\n", unique)},
+        {"get 0\r\n", "END\r\n"},
+        {"get\r\n", "ERROR\r\n"},
+        {"get " + strings.Repeat("1", 251) + "\r\n", "CLIENT_ERROR bad command line format\r\n"},
+        {"set 1 0 0 1\r\n", "ERROR\r\n"},
+        {"\r\n", "ERROR\r\n"},
+        {"version\r\n", "VERSION " + server_version + "\r\n"},
+    }
+    go func() {
+        for _, r := range requests {
+            client.Write([]byte(r.req))
+        }
+        client.Write([]byte("stats\r\nquit\r\n"))
+    }()
+
+    want := ""
+    for _, r := range requests {
+        want += r.want
+    }
+    have, err := ioutil.ReadAll(client)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.HasPrefix(string(have), want) {
+        t.Fatalf("%q, want %q", abbreviate(string(have)), abbreviate(want))
+    }
+
+    stats := string(have[len(want):])
+    for _, stat := range []string{"STAT curr_items 4\r\n", "STAT cmd_get 8\r\n", "STAT get_hits 5\r\n", "STAT get_misses 3\r\n"} {
+        if !strings.Contains(stats, stat) {
+            t.Errorf("stats %q: missing %q", stats, stat)
+        }
+    }
+    if !strings.HasSuffix(stats, "END\r\n") {
+        t.Errorf("stats %q: missing END", stats)
+    }
+}
+
+func TestMemcacheLineTooLong(t *testing.T) {
+    client, _ := start_handler(t, "one\n", memcache_handler)
+
+    // A line with no end in sight is refused once it passes the limit, and the client disconnected
+    go func() {
+        client.Write([]byte("get 1\r\nget "))
+        for {
+            if _, err := client.Write([]byte(strings.Repeat("1 ", 512))); err != nil {
+                return
+            }
+        }
+    }()
+    have, err := ioutil.ReadAll(client)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := "VALUE 1 0 3\r\none\r\nEND\r\nCLIENT_ERROR line too long\r\n"; string(have) != want {
+        t.Fatalf("%q, want %q", have, want)
+    }
+}
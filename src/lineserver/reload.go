@@ -0,0 +1,174 @@
+package lineserver
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "sync/atomic"
+)
+
+var ErrReloadInProgress = errors.New("a reload is already in progress")
+
+//
+// Function: open_snapshot
+//
+// Purpose: Indexes the source file (reusing a matching index), opens it, and starts the zone
+//          owners that serve it. Returns nil if the file can't be served.
+//
+func open_snapshot(source_file string, rebuild bool, opts *Options) *clientConfig {
+    // Pre-process the specified text file, reusing a matching index from a previous run
+    opts.Logger.Printf("Opening file index on '%s'\n", source_file)
+
+    index_file, header := open_file_index(source_file, rebuild, opts.Logger)
+    if index_file == "" {
+        return nil
+    }
+
+    // Instantiate client config object; the server holds the first reference
+    cfg := &clientConfig{source: source_file, index: index_file, refs: 1}
+
+    // Partition the source file into zones, and start the zone owners
+    zones := opts.Zones
+    if zones == 0 {
+        zones = compute_zones(int64(header.SourceSize), header.Lines, opts.MaxClients)
+    }
+    store, err := open_line_store(cfg, header, opts)
+    if err != nil {
+        opts.Logger.Println("Unable to open source file:", err)
+        return nil
+    }
+    cfg.zones = start_zones(store, zones, opts.Owners)
+
+    return cfg
+}
+
+//
+// Method: Acquire
+//
+// Purpose: Returns the snapshot currently being served, with a reference held for the caller, or
+//          nil once the server has stopped and released it. A client handler keeps the same
+//          snapshot for the life of its connection; Shutdown waits for the client handlers, so
+//          they always get one.
+//
+func (s *serverState) Acquire() *clientConfig {
+    s.cfg_lock.Lock()
+    defer s.cfg_lock.Unlock()
+
+    if !s.current.Acquire() {
+        return nil
+    }
+    return s.current
+}
+
+//
+// Method: Publish
+//
+// Purpose: Atomically replaces the snapshot being served. The previous snapshot is closed once its
+//          last client handler releases it. Once shutdown has begun, the snapshot being served is
+//          the one Shutdown releases, so cfg is closed instead, and ErrServerClosed returned.
+//
+func (s *serverState) Publish(cfg *clientConfig) error {
+    s.cfg_lock.Lock()
+    if s.IsShutdown() {
+        s.cfg_lock.Unlock()
+        cfg.Release()
+        return ErrServerClosed
+    }
+    old := s.current
+    s.current = cfg
+    s.cfg_lock.Unlock()
+
+    old.zones.store.Retire()    // Ends any TAIL of the old snapshot
+    old.Release()   // Drop the server's own reference
+    return nil
+}
+
+//
+// Method: Acquire
+//
+// Purpose: Takes a reference to the snapshot, unless its last reference has already been dropped,
+//          and it is closed
+//
+func (c *clientConfig) Acquire() bool {
+    for {
+        refs := atomic.LoadInt64(&c.refs)
+        if refs < 1 {
+            return false
+        }
+        if atomic.CompareAndSwapInt64(&c.refs, refs, refs + 1) {
+            return true
+        }
+    }
+}
+
+//
+// Method: Release
+//
+// Purpose: Drops a reference to the snapshot. The last reference closes its zone owners and files.
+//
+func (c *clientConfig) Release() {
+    if atomic.AddInt64(&c.refs, -1) == 0 {
+        c.zones.store.logger.Printf("Closing retired snapshot of '%s' (%d lines)\n", c.GetSource(), c.GetLines())
+        c.zones.Close()
+    }
+}
+
+//
+// Function: reload_source
+//
+// Purpose: Builds a snapshot of the current contents of the source file, and publishes it in place
+//          of the one being served. Client handlers keep serving the old snapshot meanwhile.
+//          Returns ErrServerClosed once shutdown has begun.
+//
+func reload_source(state *serverState) error {
+    if state.IsShutdown() {
+        return ErrServerClosed
+    }
+    if !atomic.CompareAndSwapInt32(&state.reloading, 0, 1) {
+        return ErrReloadInProgress
+    }
+    defer atomic.StoreInt32(&state.reloading, 0)
+
+    return reload_snapshot(state, false)
+}
+
+//
+// Function: reload_snapshot
+//
+// Purpose: Does the work of reload_source, for a caller that has set state.reloading. Unless
+//          forced, nothing is done if the source file is unchanged.
+//
+func reload_snapshot(state *serverState, force bool) error {
+    current := state.Acquire()
+    if current == nil {
+        return ErrServerClosed
+    }
+    defer current.Release()
+
+    // Nothing to do if the source file has not changed since the current snapshot was indexed
+    src, err := os.Open(current.GetSource())
+    if err != nil {
+        return err
+    }
+    want, err := source_header(src)
+    src.Close()
+    if err != nil {
+        return err
+    }
+    have := current.zones.store.GetHeader()
+    if !force && want.SourceSize == have.SourceSize && want.SourceMtime == have.SourceMtime && want.Fingerprint == have.Fingerprint {
+        state.opts.Logger.Printf("Reload: '%s' is unchanged\n", current.GetSource())
+        return nil
+    }
+
+    cfg := open_snapshot(current.GetSource(), false, state.opts)
+    if cfg == nil {
+        return fmt.Errorf("unable to load '%s'", current.GetSource())
+    }
+    if err := state.Publish(cfg); err != nil {
+        return err
+    }
+
+    state.opts.Logger.Printf("Reload: now serving '%s' (%d lines)\n", cfg.GetSource(), cfg.GetLines())
+    return nil
+}
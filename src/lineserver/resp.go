@@ -0,0 +1,287 @@
+package lineserver
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "time"
+)
+
+//
+//  Redis protocol (RESP) compatibility. Each line number is a key, so that any Redis client can
+//  read lines: GET <n>, MGET <n> ..., DBSIZE (the line count), PING, INFO and QUIT. A key that is
+//  not the number of a line in the file is a missing key, and reads as nil. Requests are arrays
+//  of bulk strings, as sent by Redis clients, or inline commands, as typed into telnet.
+//
+const resp_max_args = 64 * 1024     // Most arguments in one request, e.g. keys of an MGET
+const resp_max_bulk = 64 * 1024     // Longest argument in one request
+const resp_max_request = 4 * 1024 * 1024    // Most bytes in one request, framing included
+const resp_max_name = 128           // Most bytes of an unknown command's name echoed in its error
+
+var resp_protocol = &protocol{"resp", resp_handler, []byte("-ERR max number of clients reached\r\n")}
+
+var errRespProtocol = errors.New("Protocol error")
+var errRespTooLarge = errors.New("Protocol error: request too large")
+
+//
+// Function: read_resp_command
+//
+// Purpose: Reads one request, and returns its arguments. A request of more than resp_max_request
+//          bytes fails with errRespTooLarge, before the rest of it is read. An error other than
+//          errRespProtocol or errRespTooLarge comes from the connection.
+//
+func read_resp_command(reader *bufio.Reader) ([]string, error) {
+    remaining := resp_max_request
+    line, err := read_resp_line(reader, &remaining)
+    if err != nil {
+        return nil, err
+    }
+    if !strings.HasPrefix(line, "*") {
+        return strings.Fields(line), nil    // Inline command
+    }
+
+    count, err := strconv.Atoi(line[1:])
+    if err != nil || count < 0 || count > resp_max_args {
+        return nil, errRespProtocol
+    }
+    args := make([]string, 0, count)
+    for i := 0; i < count; i++ {
+        if line, err = read_resp_line(reader, &remaining); err != nil {
+            return nil, err
+        }
+        size, err := strconv.Atoi(strings.TrimPrefix(line, "$"))
+        if !strings.HasPrefix(line, "$") || err != nil || size < 0 || size > resp_max_bulk {
+            return nil, errRespProtocol
+        }
+        if size + 2 > remaining {
+            return nil, errRespTooLarge
+        }
+        remaining -= size + 2
+        bulk := make([]byte, size + 2)
+        if _, err := io.ReadFull(reader, bulk); err != nil {
+            return nil, err
+        }
+        if string(bulk[size:]) != "\r\n" {
+            return nil, errRespProtocol
+        }
+        args = append(args, string(bulk[:size]))
+    }
+    return args, nil
+}
+
+//
+// Function: read_resp_line
+//
+// Purpose: Reads one CR-LF (or LF) terminated line of a request, without its terminator, and
+//          deducts its length from the bytes remaining to the request
+//
+func read_resp_line(reader *bufio.Reader, remaining *int) (string, error) {
+    var line []byte
+    for {
+        part, err := reader.ReadSlice('\n')
+        if len(part) > *remaining {
+            return "", errRespTooLarge
+        }
+        *remaining -= len(part)
+        line = append(line, part...)
+        if err != bufio.ErrBufferFull {
+            if err != nil {
+                return "", err
+            }
+            break
+        }
+    }
+    return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+//
+// Function: resp_printable
+//
+// Purpose: Returns a client-supplied name as it can safely be echoed in an error reply: control
+//          characters, which could end the reply early, become spaces, and it is cut to
+//          resp_max_name bytes
+//
+func resp_printable(name string) string {
+    if len(name) > resp_max_name {
+        name = name[:resp_max_name]
+    }
+    return strings.Map(func(r rune) rune {
+        if r < ' ' || r == 0x7f {
+            return ' '
+        }
+        return r
+    }, name)
+}
+
+//
+// Function: parse_key
+//
+// Purpose: Returns the line number named by a key, or 0 (never a line) if it is not a number
+//
+func parse_key(key string) uint64 {
+    line, err := strconv.ParseUint(key, 10, 64)
+    if err != nil {
+        return 0
+    }
+    return line
+}
+
+//
+// Function: write_bulk
+//
+// Purpose: Writes a textReply as a bulk string, or as nil if the line could not be retrieved
+//
+func write_bulk(w io.Writer, reply *textReply) error {
+    hdr, ok := <-reply.chunks
+    return write_bulk_item(w, reply, hdr, ok)
+}
+
+//
+// Function: write_bulk_item
+//
+// Purpose: Writes a textReply as a bulk string, given the header chunk already received from it
+//
+func write_bulk_item(w io.Writer, reply *textReply, hdr chunk, ok bool) error {
+    if !ok || hdr.err != nil {
+        reply.Abandon()
+        _, err := io.WriteString(w, "$-1\r\n")
+        return err
+    }
+
+    _, err := fmt.Fprintf(w, "$%d\r\n", hdr.size)
+    if err == nil {
+        err = write_body(w, reply, hdr.size)
+    }
+    if err != nil {
+        reply.Abandon()
+    }
+    return err
+}
+
+//
+// Function: write_resp_mget
+//
+// Purpose: Writes the lines of an MGET as an array of bulk strings, in request order
+//
+func write_resp_mget(w io.Writer, zones *zoneSet, lines []uint64) error {
+    if _, err := fmt.Fprintf(w, "*%d\r\n", len(lines)); err != nil {
+        return err
+    }
+
+    return write_window(zones, lines, func(i int, reply *textReply, hdr chunk, ok bool) error {
+        return write_bulk_item(w, reply, hdr, ok)
+    })
+}
+
+//
+// Function: write_resp_info
+//
+// Purpose: Writes the INFO fields as a bulk string, in the "name:value" format of Redis' INFO
+//
+func write_resp_info(w io.Writer, state *serverState, zones *zoneSet) error {
+    text := "# Server\r\n"
+    for _, field := range info_fields(state, zones) {
+        text += fmt.Sprintf("%s:%v\r\n", field.name, field.value)
+    }
+    _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(text), text)
+    return err
+}
+
+//
+// GoRoutine: resp_handler
+//
+// Purpose: Validates and executes the commands of a Redis client, as client_handler does for the
+//          text protocol
+//
+func resp_handler(client net.Conn, idle time.Duration, state *serverState, admin bool) {
+    state.Track(client)
+    cfg := state.Acquire()  // This connection is served from the same snapshot until it closes
+    zones := cfg.zones
+
+    // client handler closure
+    defer func() {
+        state.opts.Logger.Printf("Closing socket to %s\n", client.RemoteAddr().String())
+        cfg.Release()
+        state.Untrack(client)
+        client.Close()
+        state.clients.Release(admin)
+        state.Done()
+    }()
+
+    reader := bufio.NewReader(client)
+    writer := bufio.NewWriter(&stallConn{client, state.opts.WriteTimeout})  // A client that stops reading is disconnected
+    done := false
+
+    for !done {
+        // Set idle timeout; at shutdown, the wait is cut short by Drain
+        state.SetIdleDeadline(client, idle)
+
+        args, err := read_resp_command(reader)
+        if err == errRespProtocol || err == errRespTooLarge {
+            // The rest of the stream can't be parsed reliably
+            writer.WriteString("-ERR " + err.Error() + "\r\n")
+            writer.Flush()
+            break
+        }
+        if err != nil {
+            if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+                if state.IsShutdown() {
+                    state.opts.Logger.Println("Client received shutdown signal")
+                } else {
+                    state.opts.Logger.Println("Client idle timeout")
+                }
+            } else if err != io.EOF {
+                state.opts.Logger.Println("Client read error: ", err)
+            }
+            break
+        }
+        if len(args) == 0 {
+            continue
+        }
+
+        cmd := strings.ToUpper(args[0])
+        state.opts.Logger.Println("Command: " + strings.Join(args, " "))
+
+        var err2 error
+        switch {
+        case cmd == "GET" && len(args) == 2:
+            err2 = write_bulk(writer, zones.Get(parse_key(args[1])))
+        case cmd == "MGET" && len(args) >= 2:
+            lines := make([]uint64, len(args) - 1)
+            for i, key := range args[1:] {
+                lines[i] = parse_key(key)
+            }
+            err2 = write_resp_mget(writer, zones, lines)
+        case cmd == "DBSIZE" && len(args) == 1:
+            _, err2 = fmt.Fprintf(writer, ":%d\r\n", zones.store.GetLines())
+        case cmd == "PING" && len(args) == 1:
+            _, err2 = writer.WriteString("+PONG\r\n")
+        case cmd == "PING" && len(args) == 2:
+            _, err2 = fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(args[1]), args[1])
+        case cmd == "INFO" && len(args) <= 2:
+            err2 = write_resp_info(writer, state, zones)
+        case cmd == "SELECT" && len(args) == 2 && args[1] == "0":
+            _, err2 = writer.WriteString("+OK\r\n")     // The only database
+        case cmd == "COMMAND":
+            _, err2 = writer.WriteString("*0\r\n")      // Sent by redis-cli on connecting
+        case cmd == "QUIT":
+            _, err2 = writer.WriteString("+OK\r\n")
+            done = true
+        case cmd == "GET" || cmd == "MGET" || cmd == "DBSIZE" || cmd == "PING" || cmd == "INFO" || cmd == "SELECT":
+            _, err2 = fmt.Fprintf(writer, "-ERR wrong number of arguments for '%s' command\r\n", strings.ToLower(cmd))
+        default:
+            _, err2 = fmt.Fprintf(writer, "-ERR unknown command '%s'\r\n", resp_printable(strings.ToLower(cmd)))
+        }
+        if err2 == nil {
+            err2 = writer.Flush()
+        }
+        if err2 != nil {
+            state.opts.Logger.Println("Client write error: ", err2)
+            done = true
+        }
+    }
+}
@@ -0,0 +1,92 @@
+package lineserver
+
+import (
+    "bufio"
+    "fmt"
+    "io/ioutil"
+    "strings"
+    "testing"
+)
+
+//
+// Function: resp_request
+//
+// Purpose: Encodes a request as an array of bulk strings, as Redis clients send them
+//
+func resp_request(args ...string) string {
+    req := fmt.Sprintf("*%d\r\n", len(args))
+    for _, arg := range args {
+        req += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+    }
+    return req
+}
+
+func TestRespCommands(t *testing.T) {
+    client, _ := start_handler(t, "one\n  two  \n" + long_line + "\n\n", resp_handler)
+
+    long := strings.TrimSpace(long_line)
+    requests := []struct {
+        req  string
+        want string
+    }{
+        {resp_request("PING"), "+PONG\r\n"},
+        {"PING hello\r\n", "$5\r\nhello\r\n"},
+        {resp_request("GET", "1"), "$3\r\none\r\n"},
+        {resp_request("get", "2"), "$3\r\ntwo\r\n"},
+        {resp_request("GET", "4"), "$0\r\n\r\n"},
+        {resp_request("GET", "0"), "$-1\r\n"},
+        {resp_request("GET", "5"), "$-1\r\n"},
+        {resp_request("GET", "key"), "$-1\r\n"},
+        {resp_request("MGET", "2", "9", "3", "1"), "*4\r\n$3\r\ntwo\r\n$-1\r\n" + fmt.Sprintf("$%d\r\n%s\r\n", len(long), long) + "$3\r\none\r\n"},
+        {resp_request("DBSIZE"), ":4\r\n"},
+        {resp_request("GET"), "-ERR wrong number of arguments for 'get' command\r\n"},
+        {resp_request("SET", "1", "x"), "-ERR unknown command 'set'\r\n"},
+        {resp_request("X\r\n+OK"), "-ERR unknown command 'x  +ok'\r\n"},
+        {resp_request("SELECT", "0"), "+OK\r\n"},
+    }
+    go func() {
+        for _, r := range requests {
+            client.Write([]byte(r.req))
+        }
+        client.Write([]byte(resp_request("QUIT")))
+    }()
+
+    want := ""
+    for _, r := range requests {
+        want += r.want
+    }
+    want += "+OK\r\n"
+    have, err := ioutil.ReadAll(client)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(have) != want {
+        t.Fatalf("%q, want %q", abbreviate(string(have)), abbreviate(want))
+    }
+}
+
+func TestRespProtocolError(t *testing.T) {
+    for _, req := range []string{"*x\r\n", "*-1\r\n", "*-9223372036854775808\r\n", "*1\r\nGET\r\n", "*1\r\n$3\r\nGETX\r\n", "*1\r\n$-5\r\n"} {
+        _, err := read_resp_command(bufio.NewReader(strings.NewReader(req)))
+        if err != errRespProtocol {
+            t.Errorf("%q: %v, want %v", req, err, errRespProtocol)
+        }
+    }
+
+    // Refused before it is read in full, whether one long inline command or many arguments
+    bulk := fmt.Sprintf("$%d\r\n%s\r\n", resp_max_bulk, strings.Repeat("x", resp_max_bulk))
+    for _, req := range []string{
+        strings.Repeat("x", resp_max_request) + "\r\n",
+        fmt.Sprintf("*%d\r\n", resp_max_args) + strings.Repeat(bulk, resp_max_request / resp_max_bulk),
+    } {
+        _, err := read_resp_command(bufio.NewReader(strings.NewReader(req)))
+        if err != errRespTooLarge {
+            t.Errorf("%d byte request: %v, want %v", len(req), err, errRespTooLarge)
+        }
+    }
+
+    args, err := read_resp_command(bufio.NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$4\r\n1\r\n2\r\n")))
+    if err != nil || len(args) != 2 || args[1] != "1\r\n2" {
+        t.Errorf("binary-safe argument: %q %v", args, err)
+    }
+}
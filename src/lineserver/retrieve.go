@@ -0,0 +1,906 @@
+package lineserver
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "sync"
+    "sync/atomic"
+    "unicode"
+    "unicode/utf8"
+)
+
+const chunk_depth = 4   // Chunks buffered between a streamer and a client handler
+const mget_window = 64  // MGET items fetched at once; bounds an MGET's memory to mget_window chunks
+
+const default_chunk_size = 64 * 1024  // Bytes per chunk; bounds the memory used by one request, regardless of line length
+
+var chunk_pool = sync.Pool{
+    New: func() interface{} {
+        return new([]byte)
+    },
+}
+
+var errOutOfRange = errors.New("line out of range")
+
+const (
+    TrimSpace = "space"   // Strip leading and trailing whitespace, as strings.TrimSpace
+    TrimExact = "exact"   // Strip only the line terminator (LF or CRLF)
+)
+
+//
+//  Store interface - the source of the lines' text: the source file itself, unless Options.OpenStore
+//  supplies another. It must hold the same bytes as the source file, from which the index is built,
+//  and be safe for concurrent positional reads by all streamers.
+//
+type Store interface {
+    io.ReaderAt
+    io.Closer
+}
+
+//
+//  lineStore object and methods - the shared handles of one served file. All reads are positional
+//  (ReadAt), so a single source handle and index serve every streamer concurrently. In follow
+//  mode the line count and header grow as lines are appended to the source file.
+//
+type lineStore struct {
+    src        Store
+    index      Index
+    rewrite    *sync.RWMutex  // Held for writing while the follower rewrites a published record; see Lookup
+    trim       string         // Options.TrimMode
+    chunk_size int            // Options.ChunkSize
+    lines      uint64         // Updated atomically
+    hdr_lock   *sync.Mutex
+    header     IndexHeader
+    grown      chan struct{}  // Closed, and replaced, whenever lines are added; see Grown
+    retired    bool           // Set once a reload has replaced the snapshot; it never grows again
+    partial    bool           // The last line has no newline (yet)
+    logger     *log.Logger    // Options.Logger
+}
+
+//
+// Method: Lookup
+//
+// Purpose: Returns the {offset, length} record of a line from the index. In follow mode, the
+//          record of a partial last line is rewritten in place as the line grows, so the lookup
+//          waits until the record is whole again.
+//
+func (s *lineStore) Lookup(line uint64) (uint64, uint64, error) {
+    s.rewrite.RLock()
+    defer s.rewrite.RUnlock()
+    return s.index.Lookup(line)
+}
+
+func (s *lineStore) GetLines() uint64 {
+    return atomic.LoadUint64(&s.lines)
+}
+
+//
+// Method: CompleteLines
+//
+// Purpose: Returns the number of lines that end with a newline, i.e. excluding a partial last line
+//          that may still grow in follow mode
+//
+func (s *lineStore) CompleteLines() uint64 {
+    s.hdr_lock.Lock()
+    defer s.hdr_lock.Unlock()
+
+    lines := atomic.LoadUint64(&s.lines)
+    if s.partial {
+        lines--
+    }
+    return lines
+}
+
+func (s *lineStore) IsPartial() bool {
+    s.hdr_lock.Lock()
+    defer s.hdr_lock.Unlock()
+    return s.partial
+}
+
+func (s *lineStore) GetHeader() IndexHeader {
+    s.hdr_lock.Lock()
+    defer s.hdr_lock.Unlock()
+    return s.header
+}
+
+//
+// Method: Grown
+//
+// Purpose: Returns a channel that is closed when lines are next added to the store, or when the
+//          store is retired. Take the channel before checking the line count, so as not to miss
+//          lines added in between.
+//
+func (s *lineStore) Grown() <-chan struct{} {
+    s.hdr_lock.Lock()
+    defer s.hdr_lock.Unlock()
+    return s.grown
+}
+
+func (s *lineStore) Retired() bool {
+    s.hdr_lock.Lock()
+    defer s.hdr_lock.Unlock()
+    return s.retired
+}
+
+//
+// Method: Retire
+//
+// Purpose: Marks the store as replaced by a newer snapshot, and wakes anyone waiting for it to grow
+//
+func (s *lineStore) Retire() {
+    s.hdr_lock.Lock()
+    defer s.hdr_lock.Unlock()
+
+    if !s.retired {
+        s.retired = true
+        close(s.grown)
+    }
+}
+
+//
+// Method: ExtendIndex
+//
+// Purpose: Adds the records of newly indexed lines to the index, from line first onwards. They are
+//          not served until Extend publishes the new line count, so a line is never served before
+//          its record can be looked up.
+//
+func (s *lineStore) ExtendIndex(first uint64, records []uint64) error {
+    index, ok := s.index.(extendableIndex)
+    if !ok {
+        return errIndexFixed
+    }
+    return index.Extend(first, records)
+}
+
+//
+// Method: Extend
+//
+// Purpose: Publishes the lines added to the index by ExtendIndex, and describes the source file by
+//          hdr. Tailing client handlers are woken if the lines have grown.
+//
+func (s *lineStore) Extend(hdr IndexHeader, partial bool, grown bool) {
+    s.hdr_lock.Lock()
+    defer s.hdr_lock.Unlock()
+
+    s.header = hdr
+    s.partial = partial
+    atomic.StoreUint64(&s.lines, hdr.Lines)
+    if grown && !s.retired {
+        close(s.grown)  // Wake the tailing client handlers
+        s.grown = make(chan struct{})
+    }
+}
+
+func (s *lineStore) Close() {
+    s.index.Close()
+    s.src.Close()
+}
+
+//
+// Function: open_line_store
+//
+// Purpose: Opens the source file and its index, using the requested index access mode, or the
+//          Store and Index supplied by the options
+//
+func open_line_store(cfg *clientConfig, header IndexHeader, opts *Options) (*lineStore, error) {
+    var src Store
+    var err error
+    if opts.OpenStore != nil {
+        src, err = opts.OpenStore(cfg.GetSource())
+    } else {
+        src, err = os.Open(cfg.GetSource())
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var index Index
+    if opts.OpenIndex != nil {
+        index, err = opts.OpenIndex(cfg.GetIndex(), header.Lines)
+    } else {
+        index, err = open_line_index(cfg.GetIndex(), header.Lines, opts.IndexMode, opts.IndexBudget, opts.Logger)
+    }
+    if err != nil {
+        src.Close()
+        return nil, err
+    }
+
+    store := &lineStore{src, index, new(sync.RWMutex), opts.TrimMode, opts.ChunkSize, header.Lines, new(sync.Mutex), header,
+        make(chan struct{}), false, false, opts.Logger}
+    if store.partial, err = last_line_partial(src, index, header.Lines); err != nil {
+        store.Close()
+        return nil, err
+    }
+    return store, nil
+}
+
+//
+// Function: last_line_partial
+//
+// Purpose: Reports whether the last indexed line is missing its newline
+//
+func last_line_partial(src io.ReaderAt, index Index, lines uint64) (bool, error) {
+    if lines == 0 {
+        return false, nil
+    }
+    offset, length, err := index.Lookup(lines)
+    if err != nil {
+        return false, err
+    }
+
+    var last [1]byte
+    if err := read_at(src, last[:], offset + length - 1); err != nil {
+        return false, err
+    }
+    return last[0] != '\n', nil
+}
+
+//
+// Function: get_chunk
+//
+// Purpose: Takes a chunk buffer of size bytes from the pool
+//
+func get_chunk(size int) *[]byte {
+    b := chunk_pool.Get().(*[]byte)
+    if cap(*b) < size {
+        *b = make([]byte, size)
+    }
+    *b = (*b)[:size]
+    return b
+}
+
+//
+// Function: release_chunk
+//
+// Purpose: Returns a chunk buffer to the pool
+//
+func release_chunk(b *[]byte) {
+    if b != nil {
+        *b = (*b)[:cap(*b)]
+        chunk_pool.Put(b)
+    }
+}
+
+//
+//  chunk object - one message on a textReply channel
+//
+type chunk struct {
+    size     uint64     // Header only: the number of bytes that follow in data chunks
+    deferred bool       // Header only: the line is too long for an inline-only reply, so no data follows
+    data     *[]byte    // Pooled buffer; nil for the header
+    err      error
+}
+
+//
+//  textReply object and methods - carries a line's text from its streamer to a client handler.
+//  The streamer sends a header chunk (or an error), then the data chunks, then closes the channel.
+//  At most chunk_depth + 2 chunks of a request are in memory at any time.
+//
+type textReply struct {
+    chunks      chan chunk
+    cancel      chan struct{}   // Closed by the client handler if it abandons the reply
+    inline_only bool            // Lines longer than a chunk are deferred rather than sent
+}
+
+func new_text_reply() *textReply {
+    return &textReply{make(chan chunk, chunk_depth), make(chan struct{}), false}
+}
+
+//
+// Method: send
+//
+// Purpose: Used by the streamer to send a chunk. Returns false if the client handler has abandoned the reply.
+//
+func (r *textReply) send(c chunk) bool {
+    select {
+    case r.chunks <- c:
+        return true
+    case <-r.cancel:
+        release_chunk(c.data)
+        return false
+    }
+}
+
+//
+// Method: Abandon
+//
+// Purpose: Used by the client handler to release the streamer, and any chunks already sent
+//
+func (r *textReply) Abandon() {
+    close(r.cancel)
+    for c := range r.chunks {
+        release_chunk(c.data)
+    }
+}
+
+//
+// Function: is_space
+//
+// Purpose: Reports whether b is an ASCII whitespace byte, as trimmed by strings.TrimSpace. Bytes
+//          from utf8.RuneSelf up begin multi-byte runes, which are decoded instead.
+//
+func is_space(b byte) bool {
+    switch b {
+    case ' ', '\t', '\n', '\v', '\f', '\r':
+        return true
+    }
+    return false
+}
+
+//
+// Function: read_at
+//
+// Purpose: Reads exactly len(buf) bytes at the given offset. Short reads are retried for the
+//          remainder; reaching the end of the file first means the file has shrunk.
+//
+func read_at(src io.ReaderAt, buf []byte, offset uint64) error {
+    for len(buf) > 0 {
+        n, err := src.ReadAt(buf, int64(offset))
+        buf = buf[n:]
+        offset += uint64(n)
+        if len(buf) == 0 {
+            break
+        }
+        if err == io.EOF {
+            return io.ErrUnexpectedEOF
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+//
+// Function: trim_range
+//
+// Purpose: Narrows the {offset, length} of a line to exclude leading and trailing whitespace, as
+//          strings.TrimSpace does (Unicode whitespace included), reading at most one chunk at a
+//          time from either end of the line. In exact mode, only the line terminator is excluded.
+//
+func trim_range(src io.ReaderAt, buf []byte, offset uint64, length uint64, trim string) (uint64, uint64, error) {
+    if trim == TrimExact {
+        var tail [2]byte    // Not buf, which may be smaller than a CR-LF
+        n := length
+        if n > 2 {
+            n = 2
+        }
+        if err := read_at(src, tail[:n], offset + length - n); err != nil {
+            return 0, 0, err
+        }
+        return offset, length - uint64(terminator_length(tail[:n])), nil
+    }
+
+    // Every rune must fit a chunk, so that it can be decoded
+    var small [utf8.UTFMax]byte
+    if len(buf) < len(small) {
+        buf = small[:]
+    }
+    start, end := offset, offset + length
+
+    // Skip leading whitespace. A rune cut short by the end of a chunk is read again with the next.
+    for start < end {
+        n := end - start
+        if n > uint64(len(buf)) {
+            n = uint64(len(buf))
+        }
+        if err := read_at(src, buf[:n], start); err != nil {
+            return 0, 0, err
+        }
+        i, found := uint64(0), false
+        for i < n {
+            if buf[i] < utf8.RuneSelf {
+                if !is_space(buf[i]) {
+                    found = true
+                    break
+                }
+                i++
+                continue
+            }
+            if !utf8.FullRune(buf[i:n]) && start + n < end {
+                break
+            }
+            r, size := utf8.DecodeRune(buf[i:n])
+            if !unicode.IsSpace(r) {
+                found = true
+                break
+            }
+            i += uint64(size)
+        }
+        start += i
+        if found {
+            break
+        }
+    }
+
+    // Skip trailing whitespace. A rune cut short by the start of a chunk is read again with the next.
+    for end > start {
+        n := end - start
+        if n > uint64(len(buf)) {
+            n = uint64(len(buf))
+        }
+        if err := read_at(src, buf[:n], end - n); err != nil {
+            return 0, 0, err
+        }
+        i, found := n, false
+        for i > 0 {
+            if buf[i - 1] < utf8.RuneSelf {
+                if !is_space(buf[i - 1]) {
+                    found = true
+                    break
+                }
+                i--
+                continue
+            }
+            k := i - 1
+            for k > 0 && i - k < utf8.UTFMax && !utf8.RuneStart(buf[k]) {
+                k--
+            }
+            if k == 0 && !utf8.RuneStart(buf[0]) && i < utf8.UTFMax && end - n > start {
+                break
+            }
+            r, size := utf8.DecodeLastRune(buf[:i])
+            if !unicode.IsSpace(r) {
+                found = true
+                break
+            }
+            i -= uint64(size)
+        }
+        end -= n - i
+        if found {
+            break
+        }
+    }
+
+    return start, end - start, nil
+}
+
+//
+// Function: trim_bytes
+//
+// Purpose: In-memory counterpart of trim_range
+//
+func trim_bytes(b []byte, trim string) []byte {
+    if trim == TrimExact {
+        return b[:len(b) - terminator_length(b)]
+    }
+    return bytes.TrimSpace(b)
+}
+
+//
+// Function: terminator_length
+//
+// Purpose: Returns the length of the LF or CRLF at the end of b, if any
+//
+func terminator_length(b []byte) int {
+    n := len(b)
+    switch {
+    case n >= 2 && b[n - 2] == '\r' && b[n - 1] == '\n':
+        return 2
+    case n >= 1 && b[n - 1] == '\n':
+        return 1
+    }
+    return 0
+}
+
+//
+// Function: send_line
+//
+// Purpose: Sends the text of the line at {offset, length} of the source file as a header chunk
+//          followed by data chunks. Returns false if the reply has been abandoned or failed.
+//
+func send_line(store *lineStore, offset uint64, length uint64, reply *textReply) bool {
+    buf := get_chunk(store.chunk_size)
+    offset, length, err := trim_range(store.src, *buf, offset, length, store.trim)
+    release_chunk(buf)
+    if err != nil {
+        store.logger.Println("Source read failed:", err)
+        reply.send(chunk{err: err})
+        return false
+    }
+
+    if reply.inline_only && length > uint64(store.chunk_size) {
+        reply.send(chunk{size: length, deferred: true})
+        return false
+    }
+    if !reply.send(chunk{size: length}) {
+        return false
+    }
+
+    // Send the line in chunks; the client handler returns each buffer to the pool once written
+    for length > 0 {
+        buf := get_chunk(store.chunk_size)
+        n := uint64(len(*buf))
+        if n > length {
+            n = length
+        }
+        if err := read_at(store.src, (*buf)[:n], offset); err != nil {
+            store.logger.Println("Source read failed:", err)
+            release_chunk(buf)
+            reply.send(chunk{err: err})
+            return false
+        }
+        *buf = (*buf)[:n]
+        if !reply.send(chunk{data: buf}) {
+            return false
+        }
+        offset += n
+        length -= n
+    }
+    return true
+}
+
+//
+// Function: send_bytes
+//
+// Purpose: Sends a line that is already in memory (and no longer than a chunk) as a header chunk
+//          and a single data chunk
+//
+func send_bytes(store *lineStore, text []byte, reply *textReply) bool {
+    text = trim_bytes(text, store.trim)
+    if !reply.send(chunk{size: uint64(len(text))}) {
+        return false
+    }
+    if len(text) == 0 {
+        return true
+    }
+    buf := get_chunk(store.chunk_size)
+    *buf = (*buf)[:copy(*buf, text)]
+    return reply.send(chunk{data: buf})
+}
+
+//
+// Function: find_line_end
+//
+// Purpose: Scans the source file from the given offset for the end of the current line. Returns
+//          the offset just past its newline, or the end of the file.
+//
+func find_line_end(src io.ReaderAt, buf []byte, offset uint64) (uint64, error) {
+    for {
+        n, err := src.ReadAt(buf, int64(offset))
+        if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+            return offset + uint64(i) + 1, nil
+        }
+        offset += uint64(n)
+        if err == io.EOF {
+            return offset, nil
+        }
+        if err != nil {
+            return 0, err
+        }
+    }
+}
+
+//
+// Function: locate_lines
+//
+// Purpose: Used by the zone owner to look up the requested line, or the first of count consecutive
+//          lines, in the index
+//
+func locate_lines(store *lineStore, first uint64, count uint64) location {
+    // Sanity check the requested lines against the total number of lines available
+    lines := store.GetLines()
+    if first < 1 || first > lines || (count > 0 && count > lines - first + 1) {
+        return location{err: errOutOfRange}
+    }
+
+    // Retrieve the offset and length of the requested line
+    offset, length, err := store.Lookup(first)
+    if err != nil {
+        store.logger.Println("Index lookup failed:", err)
+        return location{err: err}
+    }
+    return location{offset, length, nil}
+}
+
+//
+// Function: stream_text
+//
+// Purpose: Retrieves the text of the specified line, located by its zone owner, and sends it to
+//          the client handler in chunks
+//
+func stream_text(store *lineStore, line uint64, loc location, reply *textReply) {
+    defer close(reply.chunks)
+
+    send_line(store, loc.offset, loc.length, reply)
+}
+
+//
+// Function: stream_range
+//
+// Purpose: Retrieves count consecutive lines, starting at the specified line number at offset pos
+//          of the source file, and sends each of them to the client handler as for stream_text.
+//          Only the first line is looked up in the index; the rest are found by reading the source
+//          file sequentially.
+//
+func stream_range(store *lineStore, first uint64, count uint64, pos uint64, reply *textReply) {
+    defer close(reply.chunks)
+
+    bufp := get_chunk(store.chunk_size)
+    defer release_chunk(bufp)
+    buf := *bufp
+
+    // buf[start:filled] holds the unsent source bytes at offset pos + start
+    var start, filled int
+    var sent uint64
+    eof := false
+    for sent < count {
+        if i := bytes.IndexByte(buf[start:filled], '\n'); i >= 0 {
+            if !send_bytes(store, buf[start:start + i + 1], reply) {
+                return
+            }
+            start += i + 1
+            sent++
+            continue
+        }
+
+        if eof {
+            // The final line of the file need not end with a newline
+            if start < filled {
+                if !send_bytes(store, buf[start:filled], reply) {
+                    return
+                }
+                sent++
+            }
+            if sent < count {
+                store.logger.Println("Source read failed:", io.ErrUnexpectedEOF)
+                reply.send(chunk{err: io.ErrUnexpectedEOF})
+            }
+            return
+        }
+
+        if start == 0 && filled == len(buf) {
+            // This line is longer than a chunk: find its end, and stream it like a single line
+            end, err := find_line_end(store.src, buf, pos + uint64(filled))
+            if err != nil {
+                store.logger.Println("Source read failed:", err)
+                reply.send(chunk{err: err})
+                return
+            }
+            if !send_line(store, pos, end - pos, reply) {
+                return
+            }
+            sent++
+            pos, filled = end, 0
+            continue
+        }
+
+        // Keep the partial line, and refill the rest of the buffer
+        copy(buf, buf[start:filled])
+        pos += uint64(start)
+        filled -= start
+        start = 0
+
+        n, err := store.src.ReadAt(buf[filled:], int64(pos) + int64(filled))
+        filled += n
+        if err == io.EOF {
+            eof = true
+        } else if err != nil {
+            store.logger.Println("Source read failed:", err)
+            reply.send(chunk{err: err})
+            return
+        }
+    }
+}
+
+//
+//  Response framing, negotiated per connection with the FRAMING command
+//
+const (
+    framing_line   = "line"     // OK\r\n<text>\r\n; the text can't be told apart from an embedded CR-LF
+    framing_length = "length"   // OK <len>\r\n<bytes>\r\n; the line is returned as any number of bytes
+)
+
+//
+// Function: write_ok
+//
+// Purpose: Writes the OK header of a response carrying a single line of size bytes
+//
+func write_ok(w io.Writer, framing string, size uint64) error {
+    var err error
+    if framing == framing_length {
+        _, err = fmt.Fprintf(w, "OK %d\r\n", size)
+    } else {
+        _, err = io.WriteString(w, "OK\r\n")
+    }
+    return err
+}
+
+//
+// Function: write_length
+//
+// Purpose: Writes the length prefix of a line within a multi-line response, in length framing
+//
+func write_length(w io.Writer, framing string, size uint64) error {
+    if framing != framing_length {
+        return nil
+    }
+    _, err := fmt.Fprintf(w, "%d\r\n", size)
+    return err
+}
+
+//
+// Function: write_body
+//
+// Purpose: Copies the data chunks of one line to the client, followed by the terminating CR-LF
+//
+func write_body(w io.Writer, reply *textReply, size uint64) error {
+    if err := write_data(w, reply, size); err != nil {
+        return err
+    }
+    _, err := io.WriteString(w, "\r\n")
+    return err
+}
+
+//
+// Function: write_data
+//
+// Purpose: Copies the data chunks of one line to the client
+//
+func write_data(w io.Writer, reply *textReply, size uint64) error {
+    for size > 0 {
+        c, ok := <-reply.chunks
+        if !ok {
+            c.err = io.ErrUnexpectedEOF
+        }
+        if c.err != nil {
+            return c.err
+        }
+        _, err := w.Write(*c.data)
+        size -= uint64(len(*c.data))
+        release_chunk(c.data)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+//
+// Function: write_text
+//
+// Purpose: Writes a textReply to the client as an OK response, or as ERR if the line could not be
+//          retrieved. An error is returned only if the connection can no longer be used.
+//
+func write_text(w io.Writer, reply *textReply, framing string) error {
+    return write_lines(w, reply, 0, framing)
+}
+
+//
+// Function: write_range
+//
+// Purpose: Retrieves count consecutive lines from the zone owners, and writes them to the client
+//
+func write_range(w io.Writer, zones *zoneSet, first uint64, count uint64, framing string) error {
+    return write_lines(w, zones.GetRange(first, count), count, framing)
+}
+
+//
+// Function: write_mget
+//
+// Purpose: Retrieves an arbitrary list of lines, and writes them to the client in request order as
+//          an "OK <count>" header followed by an OK or ERR response per line
+//
+func write_mget(w io.Writer, zones *zoneSet, lines []uint64, framing string) error {
+    if _, err := fmt.Fprintf(w, "OK %d\r\n", len(lines)); err != nil {
+        return err
+    }
+
+    return write_window(zones, lines, func(i int, reply *textReply, hdr chunk, ok bool) error {
+        return write_item(w, reply, hdr, ok, framing)
+    })
+}
+
+//
+// Function: write_window
+//
+// Purpose: Retrieves an arbitrary list of lines, mget_window lines at a time, and passes each to
+//          item in request order, with the header chunk already received from its reply.
+//          Within a window the lines are read in ascending order by a single streamer, so that the
+//          source file is read sequentially where possible. Lines longer than a chunk are streamed
+//          separately when their turn comes, so that a window never holds more than a chunk per
+//          line. item must consume or abandon the reply; if it fails, the rest of the window
+//          is abandoned and its error returned.
+//
+func write_window(zones *zoneSet, lines []uint64, item func(i int, reply *textReply, hdr chunk, ok bool) error) error {
+    for base := 0; base < len(lines); base += mget_window {
+        window := lines[base:]
+        if len(window) > mget_window {
+            window = window[:mget_window]
+        }
+
+        replies := zones.GetWindow(window)
+        for i, reply := range replies {
+            hdr, ok := <-reply.chunks
+            if ok && hdr.deferred {
+                reply.Abandon()
+                reply = zones.Get(window[i])
+                hdr, ok = <-reply.chunks
+            }
+            if err := item(base + i, reply, hdr, ok); err != nil {
+                for _, r := range replies[i + 1:] {
+                    r.Abandon()
+                }
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+//
+// Function: write_item
+//
+// Purpose: Writes one MGET item, given the header chunk already received from its reply. A failed
+//          item gets an ERR response without failing the batch.
+//
+func write_item(w io.Writer, reply *textReply, hdr chunk, ok bool, framing string) error {
+    if !ok || hdr.err != nil {
+        reply.Abandon()
+        _, err := io.WriteString(w, "ERR\r\n")
+        return err
+    }
+
+    if err := write_ok(w, framing, hdr.size); err != nil {
+        reply.Abandon()
+        return err
+    }
+    err := write_body(w, reply, hdr.size)
+    if err != nil {
+        reply.Abandon()
+    }
+    return err
+}
+
+//
+// Function: write_lines
+//
+// Purpose: Writes a textReply carrying count lines to the client, as an "OK <count>" header
+//          followed by the lines. A count of 0 writes a single line with a bare OK header. In
+//          length framing, each line of a multi-line response is preceded by its length.
+//
+func write_lines(w io.Writer, reply *textReply, count uint64, framing string) error {
+    hdr, ok := <-reply.chunks
+    if !ok || hdr.err != nil {
+        reply.Abandon()
+        _, err := io.WriteString(w, "ERR\r\n")
+        return err
+    }
+
+    var err error
+    single := count == 0
+    if single {
+        err = write_ok(w, framing, hdr.size)
+        count = 1
+    } else {
+        _, err = fmt.Fprintf(w, "OK %d\r\n", count)
+    }
+
+    for i := uint64(0); err == nil && i < count; i++ {
+        if i > 0 {
+            // The OK response is already on its way, so a failure from here on can't be recovered
+            if hdr, ok = <-reply.chunks; !ok {
+                hdr.err = io.ErrUnexpectedEOF
+            }
+            if hdr.err != nil {
+                err = hdr.err
+                break
+            }
+        }
+        if !single {
+            if err = write_length(w, framing, hdr.size); err != nil {
+                break
+            }
+        }
+        err = write_body(w, reply, hdr.size)
+    }
+
+    if err != nil {
+        reply.Abandon()
+    }
+    return err
+}
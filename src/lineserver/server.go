@@ -0,0 +1,523 @@
+//
+//  Package lineserver serves the lines of a text file by line number, over the line server's text
+//  protocol and its binary, Redis, memcached and HTTP counterparts. The line-server command is a
+//  thin wrapper around it; other programs can embed a Server in the same way:
+//
+//      srv, err := lineserver.NewServer("lines.txt", lineserver.Options{MaxClients: 100})
+//      ...
+//      go srv.Serve(listener)
+//      ...
+//      srv.Shutdown(ctx)
+//
+package lineserver
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net"
+    "sync"
+    "time"
+)
+
+var ErrServerClosed = errors.New("lineserver: server closed")
+
+//
+//  Options object - how a Server serves its source file. A zero field takes the default given in
+//  its comment; zero timeouts never expire.
+//
+type Options struct {
+    MaxClients     int            // Most concurrent clients (admin connections excepted); 0 is unlimited
+    AdmitPolicy    string         // Once MaxClients are connected: AdmitQueue (default) or AdmitReject
+    QueueTimeout   time.Duration  // How long a queued client waits for a free slot
+    IdleTimeout    time.Duration  // How long a client may be idle before it is disconnected
+    TailTimeout    time.Duration  // How long a TAIL client may accept no data before it is disconnected
+    WriteTimeout   time.Duration  // How long any other client may accept no data before it is disconnected
+    ShutdownPolicy string         // Who may use SHUTDOWN and RELOAD: ShutdownOff (default), ShutdownLoopback, ShutdownToken or ShutdownAdmin
+    AdminToken     string         // Token required under ShutdownToken
+    Zones          int            // Zones the source file is divided into; 0 sizes them automatically
+    Owners         int            // Owner GoRoutines per zone; default 1
+    IndexMode      string         // IndexAuto (default), IndexMemory, IndexMmap or IndexDisk
+    IndexBudget    uint64         // Bytes an in-memory index may use under IndexAuto; default 256MB
+    ChunkSize      int            // Bytes in which lines are copied to clients; default 64KB
+    TrimMode       string         // TrimSpace (default) or TrimExact
+    Rebuild        bool           // Rebuild the index file even if the existing one matches the source file
+    FollowInterval time.Duration  // Poll the source file for appended lines this often; 0 disables follow mode
+    Logger         *log.Logger    // Receives the server's progress messages; nil discards them
+
+    // Pluggable backends. OpenStore replaces os.Open as the source of the lines' text; OpenIndex
+    // replaces IndexMode, and is given the index file and its line count.
+    OpenStore func(source_file string) (Store, error)
+    OpenIndex func(index_file string, lines uint64) (Index, error)
+}
+
+//
+// Method: validate
+//
+// Purpose: Fills in the defaults of the options, and checks them
+//
+func (o *Options) validate() error {
+    if o.AdmitPolicy == "" {
+        o.AdmitPolicy = AdmitQueue
+    }
+    if o.ShutdownPolicy == "" {
+        o.ShutdownPolicy = ShutdownOff
+    }
+    if o.Owners == 0 {
+        o.Owners = 1
+    }
+    if o.IndexMode == "" {
+        o.IndexMode = IndexAuto
+    }
+    if o.IndexBudget == 0 {
+        o.IndexBudget = 256 * 1024 * 1024
+    }
+    if o.ChunkSize == 0 {
+        o.ChunkSize = default_chunk_size
+    }
+    if o.TrimMode == "" {
+        o.TrimMode = TrimSpace
+    }
+    if o.Logger == nil {
+        o.Logger = log.New(ioutil.Discard, "", 0)
+    }
+
+    if o.MaxClients < 0 {
+        return fmt.Errorf("invalid maximum number of clients: %d", o.MaxClients)
+    }
+    if o.AdmitPolicy != AdmitQueue && o.AdmitPolicy != AdmitReject {
+        return fmt.Errorf("invalid admission policy: %s", o.AdmitPolicy)
+    }
+    if o.QueueTimeout < 0 || o.IdleTimeout < 0 || o.TailTimeout < 0 || o.WriteTimeout < 0 || o.FollowInterval < 0 {
+        return fmt.Errorf("invalid timeouts: queue %s, idle %s, tail %s, write %s, follow %s", o.QueueTimeout, o.IdleTimeout, o.TailTimeout,
+            o.WriteTimeout, o.FollowInterval)
+    }
+    switch o.ShutdownPolicy {
+    case ShutdownOff, ShutdownLoopback, ShutdownAdmin:
+    case ShutdownToken:
+        if o.AdminToken == "" {
+            return fmt.Errorf("shutdown policy %s requires an admin token", ShutdownToken)
+        }
+    default:
+        return fmt.Errorf("invalid shutdown policy: %s", o.ShutdownPolicy)
+    }
+    switch o.IndexMode {
+    case IndexAuto, IndexMemory, IndexMmap, IndexDisk:
+    default:
+        return fmt.Errorf("invalid index mode: %s", o.IndexMode)
+    }
+    if o.Zones < 0 || o.Owners < 1 {
+        return fmt.Errorf("invalid zone configuration: %d zones, %d owners per zone", o.Zones, o.Owners)
+    }
+    if o.ChunkSize < 1 {
+        return fmt.Errorf("invalid chunk size: %d", o.ChunkSize)
+    }
+    if o.TrimMode != TrimSpace && o.TrimMode != TrimExact {
+        return fmt.Errorf("invalid trim mode: %s", o.TrimMode)
+    }
+    return nil
+}
+
+//
+//  Server object and methods - serves one source file, on any number of listeners, until it is
+//  shut down
+//
+type Server struct {
+    state   *serverState
+    release *sync.Once      // Drops the server's reference to the snapshot being served
+}
+
+//
+// Function: NewServer
+//
+// Purpose: Indexes and opens the source file (reusing a matching index), and starts the zone
+//          owners that serve it, and the follower if requested. The server is ready to Serve.
+//
+func NewServer(source_file string, opts Options) (*Server, error) {
+    if err := opts.validate(); err != nil {
+        return nil, err
+    }
+
+    cfg := open_snapshot(source_file, opts.Rebuild, &opts)
+    if cfg == nil {
+        return nil, fmt.Errorf("unable to serve '%s'", source_file)
+    }
+    s := &Server{new_server_state(&opts, cfg), new(sync.Once)}
+
+    // Index lines as they are appended to the source file, if requested
+    if opts.FollowInterval > 0 {
+        s.state.Starting()    // The follower is waited for like a client handler
+        go follow_source(s.state, opts.FollowInterval)
+    }
+    return s, nil
+}
+
+//
+// Method: Serve
+//
+// Purpose: Accepts text protocol clients on l until the server shuts down, then returns
+//          ErrServerClosed. Serve, and the other Serve methods, may be called for any number
+//          of listeners at once.
+//
+func (s *Server) Serve(l net.Listener) error {
+    return s.serve(l, false, text_protocol)
+}
+
+//
+// Method: ServeAdmin
+//
+// Purpose: As for Serve, for admin connections: they need no client slot, and may use SHUTDOWN
+//          and RELOAD under ShutdownAdmin
+//
+func (s *Server) ServeAdmin(l net.Listener) error {
+    return s.serve(l, true, text_protocol)
+}
+
+//
+// Method: ServeBinary
+//
+// Purpose: As for Serve, for clients of the pipelined binary protocol. Returns ErrServerClosed
+//          once the server shuts down.
+//
+func (s *Server) ServeBinary(l net.Listener) error {
+    return s.serve(l, false, binary_protocol)
+}
+
+//
+// Method: ServeRESP
+//
+// Purpose: As for Serve, for Redis (RESP) clients. Returns ErrServerClosed once the server shuts
+//          down.
+//
+func (s *Server) ServeRESP(l net.Listener) error {
+    return s.serve(l, false, resp_protocol)
+}
+
+//
+// Method: ServeMemcache
+//
+// Purpose: As for Serve, for memcached ASCII protocol clients. Returns ErrServerClosed once the
+//          server shuts down.
+//
+func (s *Server) ServeMemcache(l net.Listener) error {
+    return s.serve(l, false, memcache_protocol)
+}
+
+//
+// Method: ServeGateway
+//
+// Purpose: Serves the HTTP gateway on l until the server shuts down. HTTP requests need no client
+//          slot.
+//
+func (s *Server) ServeGateway(l net.Listener) error {
+    if !s.start() {
+        l.Close()
+        return ErrServerClosed
+    }
+    defer s.state.Done()
+    return serve_http(l, s.state)
+}
+
+//
+// Method: serve
+//
+// Purpose: Accepts clients of the given protocol on l until the server shuts down
+//
+func (s *Server) serve(l net.Listener, admin bool, proto *protocol) error {
+    if !s.start() {
+        l.Close()
+        return ErrServerClosed
+    }
+    defer s.state.Done()    // The listener is waited for like a client handler
+    return wait_for_clients(l, s.state, admin, proto)
+}
+
+//
+// Method: start
+//
+// Purpose: Counts a new listener, unless the server has begun to shut down
+//
+func (s *Server) start() bool {
+    return s.state.StartingUnlessShutdown()
+}
+
+//
+// Method: Shutdown
+//
+// Purpose: Shuts the server down gracefully: the listeners are closed, idle clients are
+//          disconnected, and clients in the middle of a request finish it first. Connections still
+//          busy when ctx is done are closed, and ctx's error is returned. Once every client
+//          handler has exited, the zone owners are stopped and the files closed. Shutdown may be
+//          called more than once, e.g. by a SHUTDOWN command and a signal; each call returns once
+//          the server has stopped.
+//
+func (s *Server) Shutdown(ctx context.Context) error {
+    s.state.InitiateShutdown()
+    err := drain_clients(s.state, ctx)
+    s.release.Do(func() {
+        // No client handlers remain, and no reload can publish another snapshot, so the zone
+        // owners can be stopped
+        s.state.cfg_lock.Lock()
+        current := s.state.current
+        s.state.cfg_lock.Unlock()
+        current.Release()
+    })
+    return err
+}
+
+//
+// Method: Close
+//
+// Purpose: Begins a shutdown, and closes all client connections at once, without waiting for
+//          requests in progress. Shutdown still waits for the server to stop.
+//
+func (s *Server) Close() {
+    s.state.InitiateShutdown()
+    s.state.CloseAll()
+}
+
+//
+// Method: ShuttingDown
+//
+// Purpose: Returns a channel that is closed when the server begins to shut down, whether by
+//          Shutdown, Close or an authorized SHUTDOWN command
+//
+func (s *Server) ShuttingDown() <-chan struct{} {
+    return s.state.ShuttingDown()
+}
+
+//
+// Method: Reload
+//
+// Purpose: Reindexes the source file if it has changed, and serves the new snapshot to new
+//          clients. Returns ErrReloadInProgress if a reload is already in progress, and
+//          ErrServerClosed once the server has begun to shut down.
+//
+func (s *Server) Reload() error {
+    return reload_source(s.state)
+}
+
+//
+// Method: Clients
+//
+// Purpose: Returns the number of connected clients, the peak number, and the total admitted
+//
+func (s *Server) Clients() (uint64, uint64, uint64) {
+    return s.state.clients.Active(), s.state.clients.Peak(), s.state.clients.Total()
+}
+
+//
+// Method: Lines
+//
+// Purpose: Returns the number of lines being served to new clients, or 0 once the server has stopped
+//
+func (s *Server) Lines() uint64 {
+    cfg := s.state.Acquire()
+    if cfg == nil {
+        return 0
+    }
+    defer cfg.Release()
+    return cfg.GetLines()
+}
+
+//
+//  serverState object and methods - convenience object for managing the server. Shutdown is
+//  signalled by cancelling ctx, which every GoRoutine that can block selects on.
+//
+type serverState struct {
+    cmd_get uint64                  // Keys requested by memcached clients; updated atomically
+    get_hits uint64                 // Keys found; updated atomically
+    get_misses uint64               // Keys not found; updated atomically
+    opts *Options
+    ctx context.Context
+    cancel context.CancelFunc
+    wg *sync.WaitGroup
+    clients *admission
+    started time.Time
+    conn_lock *sync.Mutex
+    conns map[net.Conn]struct{}     // Connections of the running client handlers
+    cfg_lock *sync.Mutex            // Guards current, and the start of shutdown
+    current *clientConfig           // Snapshot of the source file being served; see Acquire
+    reloading int32                 // Set while a reload is in progress; updated atomically
+    closing chan struct{}           // Closed by CloseAll, once the drain deadline has passed
+    close_once *sync.Once
+}
+
+func new_server_state(opts *Options, cfg *clientConfig) *serverState {
+    ctx, cancel := context.WithCancel(context.Background())
+    clients := new_admission(opts.MaxClients, opts.AdmitPolicy, opts.QueueTimeout)
+    return &serverState{0, 0, 0, opts, ctx, cancel, new(sync.WaitGroup), clients, time.Now(), new(sync.Mutex),
+        make(map[net.Conn]struct{}), new(sync.Mutex), cfg, 0, make(chan struct{}), new(sync.Once)}
+}
+
+func (s *serverState) IsShutdown() bool {
+    return s.ctx.Err() != nil
+}
+
+func (s *serverState) InitiateShutdown() {
+    s.cfg_lock.Lock()
+    s.cancel()
+    s.cfg_lock.Unlock()
+}
+
+func (s *serverState) ShuttingDown() <-chan struct{} {
+    return s.ctx.Done()
+}
+
+//
+// Method: Track
+//
+// Purpose: Registers a client connection, so that it can be drained at shutdown
+//
+func (s *serverState) Track(c net.Conn) {
+    s.conn_lock.Lock()
+    s.conns[c] = struct{}{}
+    s.conn_lock.Unlock()
+}
+
+func (s *serverState) Untrack(c net.Conn) {
+    s.conn_lock.Lock()
+    delete(s.conns, c)
+    s.conn_lock.Unlock()
+}
+
+//
+// Method: SetIdleDeadline
+//
+// Purpose: Arms the read deadline of a tracked connection before it waits for its next command.
+//          Once shutdown has begun the deadline is already past, so the wait ends at once.
+//
+func (s *serverState) SetIdleDeadline(c net.Conn, idle time.Duration) {
+    s.conn_lock.Lock()
+    defer s.conn_lock.Unlock()
+
+    switch {
+    case s.IsShutdown():
+        c.SetReadDeadline(time.Now())
+    case idle > 0:
+        c.SetReadDeadline(time.Now().Add(idle))
+    default:
+        c.SetReadDeadline(time.Time{})
+    }
+}
+
+//
+//  stallConn object and methods - a client connection that disconnects a client that accepts no
+//  data for its timeout, however long the response. The write deadline is pushed back before each
+//  write, so only a stalled client is cut off.
+//
+type stallConn struct {
+    net.Conn
+    timeout time.Duration   // Zero never expires
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+    var deadline time.Time
+    if c.timeout > 0 {
+        deadline = time.Now().Add(c.timeout)
+    }
+    c.SetWriteDeadline(deadline)
+    return c.Conn.Write(b)
+}
+
+//
+// Method: Drain
+//
+// Purpose: Wakes every client handler that is waiting for a command, so that it sees the shutdown
+//          and exits. Handlers that are busy with a request finish it first.
+//
+func (s *serverState) Drain() {
+    s.conn_lock.Lock()
+    defer s.conn_lock.Unlock()
+
+    for c := range s.conns {
+        c.SetReadDeadline(time.Now())
+    }
+}
+
+//
+// Method: CloseAll
+//
+// Purpose: Forcibly closes every client connection, once the drain deadline has passed
+//
+func (s *serverState) CloseAll() {
+    s.close_once.Do(func() { close(s.closing) })
+
+    s.conn_lock.Lock()
+    defer s.conn_lock.Unlock()
+
+    for c := range s.conns {
+        c.Close()
+    }
+}
+
+//
+// Method: Closing
+//
+// Purpose: Returns a channel that is closed once connections are being forcibly closed, for
+//          listeners that track their connections themselves (the HTTP gateway)
+//
+func (s *serverState) Closing() <-chan struct{} {
+    return s.closing
+}
+
+func (s *serverState) Starting() {
+    s.wg.Add(1)
+}
+
+//
+// Method: StartingUnlessShutdown
+//
+// Purpose: As for Starting, unless shutdown has begun. The check and the count are made under
+//          cfg_lock, as is InitiateShutdown, so that a GoRoutine started as Shutdown begins is
+//          either counted before Shutdown waits, or not started at all.
+//
+func (s *serverState) StartingUnlessShutdown() bool {
+    s.cfg_lock.Lock()
+    defer s.cfg_lock.Unlock()
+
+    if s.IsShutdown() {
+        return false
+    }
+    s.wg.Add(1)
+    return true
+}
+
+func (s *serverState) Done() {
+    s.wg.Done()
+}
+
+func (s *serverState) Wait() {
+    s.wg.Wait()
+}
+
+//
+//  clientConfig object and methods - contains common client config info. Each clientConfig is a
+//  snapshot of one revision of the source file, with the zone owners that serve it. In follow mode
+//  the revision grows as lines are appended, so its line count and header are read from its store.
+//
+type clientConfig struct {
+    source string
+    index  string
+    zones  *zoneSet
+    refs   int64        // References held by the server and client handlers; updated atomically
+}
+
+func (c *clientConfig) GetSource() string {
+    return c.source
+}
+
+func (c *clientConfig) GetIndex() string {
+    return c.index
+}
+
+func (c *clientConfig) GetLines() uint64 {
+    return c.zones.store.GetLines()
+}
+
+func (c *clientConfig) GetHeader() IndexHeader {
+    return c.zones.store.GetHeader()
+}
+
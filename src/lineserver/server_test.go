@@ -0,0 +1,321 @@
+package lineserver
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "io"
+    "io/ioutil"
+    "log"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+//
+//  CountingIndex object - an Index plugged in through Options.OpenIndex, counting its lookups
+//
+type CountingIndex struct {
+    Index
+    lookups int64
+}
+
+func (c *CountingIndex) Lookup(line uint64) (uint64, uint64, error) {
+    atomic.AddInt64(&c.lookups, 1)
+    return c.Index.Lookup(line)
+}
+
+//
+//  CountingStore object - a Store plugged in through Options.OpenStore, counting its reads
+//
+type CountingStore struct {
+    *os.File
+    reads  int64
+    closed int32    // Set once the store is closed; updated atomically
+}
+
+func (c *CountingStore) ReadAt(p []byte, off int64) (int, error) {
+    atomic.AddInt64(&c.reads, 1)
+    return c.File.ReadAt(p, off)
+}
+
+func (c *CountingStore) Close() error {
+    atomic.StoreInt32(&c.closed, 1)
+    return c.File.Close()
+}
+
+func TestEmbeddedServer(t *testing.T) {
+    var index *CountingIndex
+    var store *CountingStore
+    var messages bytes.Buffer
+    opts := Options{
+        MaxClients: 4,
+        Logger:     log.New(&messages, "", 0),
+        OpenIndex: func(index_file string, lines uint64) (Index, error) {
+            m, err := load_memory_index(index_file, lines)
+            index = &CountingIndex{Index: m}
+            return index, err
+        },
+        OpenStore: func(source_file string) (Store, error) {
+            f, err := os.Open(source_file)
+            store = &CountingStore{File: f}
+            return store, err
+        },
+    }
+    srv, err := NewServer(write_source(t, "one\n  two  \nthree\n"), opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if srv.Lines() != 3 {
+        t.Errorf("%d lines, want 3", srv.Lines())
+    }
+
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    served := make(chan error, 1)
+    go func() {
+        served <- srv.Serve(l)
+    }()
+
+    conn, err := net.Dial("tcp", l.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    io.WriteString(conn, "GET 2\r\nGET 4\r\nCOUNT\r\n")
+    reader := bufio.NewReader(conn)
+    for _, want := range []string{"OK\r\n", "two\r\n", "ERR\r\n", "OK\r\n", "3\r\n"} {
+        line, err := reader.ReadString('\n')
+        if err != nil || line != want {
+            t.Fatalf("%q %v, want %q", line, err, want)
+        }
+    }
+    if atomic.LoadInt64(&index.lookups) == 0 || atomic.LoadInt64(&store.reads) == 0 {
+        t.Errorf("%d index lookups and %d store reads, want some of each", index.lookups, store.reads)
+    }
+
+    // Shutdown disconnects the idle client, and ends Serve
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    if err := srv.Shutdown(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if err := <-served; err != ErrServerClosed {
+        t.Errorf("Serve returned %v, want %v", err, ErrServerClosed)
+    }
+    if _, err := reader.ReadString('\n'); err != io.EOF {
+        t.Errorf("client read %v after shutdown, want EOF", err)
+    }
+    if _, _, total := srv.Clients(); total != 1 {
+        t.Errorf("%d clients served, want 1", total)
+    }
+    if err := srv.Serve(l); err != ErrServerClosed {
+        t.Errorf("Serve after Shutdown returned %v, want %v", err, ErrServerClosed)
+    }
+    if !strings.Contains(messages.String(), "Admitted 127.0.0.1:") {
+        t.Errorf("logged %q, want the client's admission", messages.String())
+    }
+    if err := srv.Reload(); err != ErrServerClosed {
+        t.Errorf("Reload after Shutdown returned %v, want %v", err, ErrServerClosed)
+    }
+    if lines := srv.Lines(); lines != 0 {
+        t.Errorf("%d lines after Shutdown, want 0", lines)
+    }
+}
+
+//
+// Function: replace_source
+//
+// Purpose: Replaces the source file with a new file of the given content, as a deployment would,
+//          leaving the old file to the snapshots that still have it open
+//
+func replace_source(t *testing.T, source_file string, content string) {
+    t.Helper()
+    next := source_file + ".next"
+    if err := ioutil.WriteFile(next, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Rename(next, source_file); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestReload(t *testing.T) {
+    var lock sync.Mutex
+    var stores []*CountingStore  // One per snapshot
+    srv, addr, _ := start_test_server(t, "a\nb\n", Options{
+        ShutdownPolicy: ShutdownLoopback,
+        OpenStore: func(source_file string) (Store, error) {
+            f, err := os.Open(source_file)
+            lock.Lock()
+            defer lock.Unlock()
+            stores = append(stores, &CountingStore{File: f})
+            return stores[len(stores) - 1], err
+        },
+    })
+
+    // A client connected before the reload
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+    reader := bufio.NewReader(conn)
+    expect := func(requests string, want ...string) {
+        t.Helper()
+        io.WriteString(conn, requests)
+        for _, w := range want {
+            if line, err := reader.ReadString('\n'); err != nil || line != w {
+                t.Fatalf("%q %v, want %q", line, err, w)
+            }
+        }
+    }
+    expect("GET 1\r\n", "OK\r\n", "a\r\n")
+
+    replace_source(t, srv.state.current.GetSource(), "x\ny\nz\n")
+    if reply := exchange(t, addr, "RELOAD\r\n"); string(reply) != "OK\r\n" {
+        t.Fatalf("RELOAD: got %q", reply)
+    }
+    if lines := srv.Lines(); lines != 3 {
+        t.Errorf("%d lines after RELOAD, want 3", lines)
+    }
+
+    // The connected client keeps the old snapshot, and a new client gets the new one
+    expect("GET 1\r\nCOUNT\r\n", "OK\r\n", "a\r\n", "OK\r\n", "2\r\n")
+    if reply := exchange(t, addr, "GET 1\r\nCOUNT\r\n"); string(reply) != "OK\r\nx\r\nOK\r\n3\r\n" {
+        t.Errorf("new client: got %q", reply)
+    }
+
+    // The old snapshot's store is closed once its last client has gone
+    lock.Lock()
+    old := stores[0]
+    lock.Unlock()
+    if atomic.LoadInt32(&old.closed) != 0 {
+        t.Fatal("old store closed while a client was still using it")
+    }
+    expect("QUIT\r\n")
+    if _, err := reader.ReadString('\n'); err != io.EOF {
+        t.Fatalf("client read %v after QUIT, want EOF", err)
+    }
+    if atomic.LoadInt32(&old.closed) != 1 {
+        t.Error("old store still open after its last client quit")
+    }
+
+    // A reload already in progress, as by a SIGHUP, turns RELOAD away
+    atomic.StoreInt32(&srv.state.reloading, 1)
+    if reply := exchange(t, addr, "RELOAD\r\n"); string(reply) != "BUSY\r\n" {
+        t.Errorf("RELOAD during a reload: got %q", reply)
+    }
+    atomic.StoreInt32(&srv.state.reloading, 0)
+}
+
+func TestReloadDenied(t *testing.T) {
+    for _, opts := range []Options{{ShutdownPolicy: ShutdownOff}, {ShutdownPolicy: ShutdownToken, AdminToken: "secret"}} {
+        t.Run(opts.ShutdownPolicy, func(t *testing.T) {
+            srv, addr, _ := start_test_server(t, "a\n", opts)
+            replace_source(t, srv.state.current.GetSource(), "x\ny\n")
+            if reply := exchange(t, addr, "RELOAD\r\nRELOAD wrong\r\nGET 1\r\n"); string(reply) != "DENIED\r\nDENIED\r\nOK\r\na\r\n" {
+                t.Errorf("got %q", reply)
+            }
+            if lines := srv.Lines(); lines != 1 {
+                t.Errorf("%d lines after a denied RELOAD, want 1", lines)
+            }
+        })
+    }
+}
+
+func TestReloadDuringShutdown(t *testing.T) {
+    srv, err := NewServer(write_source(t, "a\nb\n"), Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // A reload that began before the shutdown, as by a SIGHUP during the drain, doesn't publish
+    srv.state.InitiateShutdown()
+    if err := reload_snapshot(srv.state, true); err != ErrServerClosed {
+        t.Errorf("reload during shutdown returned %v, want %v", err, ErrServerClosed)
+    }
+
+    // The snapshot being served is released exactly once, and can't be acquired afterwards
+    ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+    defer cancel()
+    if err := srv.Shutdown(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if cfg := srv.state.Acquire(); cfg != nil {
+        t.Errorf("acquired a snapshot with %d references after Shutdown", cfg.refs)
+    }
+}
+
+func TestServeDuringShutdown(t *testing.T) {
+    // A listener started as Shutdown begins is either waited for, or refused
+    for i := 0; i < 20; i++ {
+        srv, err := NewServer(write_source(t, "a\n"), Options{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        served := make(chan error, 1)
+        go func() { served <- srv.Serve(l) }()
+
+        ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        if err := srv.Shutdown(ctx); err != nil {
+            t.Fatal(err)
+        }
+        cancel()
+        if err := <-served; err != ErrServerClosed {
+            t.Fatalf("Serve returned %v, want %v", err, ErrServerClosed)
+        }
+    }
+}
+
+func TestInvalidOptions(t *testing.T) {
+    for _, opts := range []Options{
+        {MaxClients: -1},
+        {AdmitPolicy: "maybe"},
+        {IdleTimeout: -time.Second},
+        {WriteTimeout: -time.Second},
+        {ShutdownPolicy: ShutdownToken},
+        {IndexMode: "cloud"},
+        {TrimMode: "none"},
+        {Zones: -2},
+    } {
+        if _, err := NewServer("unused.txt", opts); err == nil {
+            t.Errorf("%+v: no error", opts)
+        }
+    }
+}
+
+func TestWriteTimeout(t *testing.T) {
+    line := strings.Repeat("x", 999)
+    srv, addr, _ := start_test_server(t, strings.Repeat(line + "\n", 16000), Options{WriteTimeout: 300 * time.Millisecond})
+
+    // A client that asks for more than the socket buffers hold, and reads none of it
+    stalled, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer stalled.Close()
+    stalled.(*net.TCPConn).SetReadBuffer(4096)
+    stalled.Write([]byte("GETRANGE 1 16000\r\n"))
+
+    // It is admitted, then disconnected once it has accepted no data for the write timeout
+    for _, want := range []uint64{1, 0} {
+        deadline := time.Now().Add(5 * time.Second)
+        for active, _, _ := srv.Clients(); active != want; active, _, _ = srv.Clients() {
+            if time.Now().After(deadline) {
+                t.Fatalf("%d clients active, want %d", active, want)
+            }
+            time.Sleep(10 * time.Millisecond)
+        }
+    }
+}
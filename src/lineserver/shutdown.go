@@ -0,0 +1,31 @@
+package lineserver
+
+import (
+    "context"
+)
+
+//
+// Function: drain_clients
+//
+// Purpose: Wakes idle client handlers and waits for all client handlers to exit. Connections that
+//          are still busy when the drain deadline (ctx) passes are closed.
+//
+func drain_clients(state *serverState, ctx context.Context) error {
+    state.Drain()
+
+    done := make(chan struct{})
+    go func() {
+        state.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+        state.opts.Logger.Println("Drain deadline passed: closing all client connections")
+        state.CloseAll()
+    }
+    <-done
+    return ctx.Err()
+}
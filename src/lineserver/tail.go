@@ -0,0 +1,127 @@
+package lineserver
+
+import (
+    "bufio"
+    "io"
+    "time"
+)
+
+const tail_batch = 256  // Lines fetched at a time by a tailing client handler
+
+//
+// Function: tail_lines
+//
+// Purpose: Implements TAIL: pushes every line from line number next onwards to the client, as an
+//          OK response per line, then waits for more lines to be indexed (see follow_source).
+//          Each batch of lines is written to the socket before the next one is fetched, so a slow
+//          client simply falls behind in the source file; a client that accepts nothing for
+//          the tail timeout is disconnected. Push mode ends when the client sends QUIT or
+//          disconnects, or when the server shuts down. Any other command, or a reload that replaces
+//          the snapshot being tailed, ends the stream with ERR.
+//
+func tail_lines(client *stallConn, reader *bufio.Reader, w *bufio.Writer, state *serverState, zones *zoneSet, next uint64, framing string) error {
+    store := zones.store
+
+    // The tail timeout replaces the write timeout
+    client.timeout = state.opts.TailTimeout
+
+    // Watch for the client ending push mode; the idle timeout no longer applies
+    client.SetReadDeadline(time.Time{})
+    stop := make(chan string, 1)
+    go func() {
+        msg, err := reader.ReadString('\n')
+        if err != nil {
+            msg = "QUIT"    // A disconnect ends push mode as QUIT does
+        }
+        stop <- msg
+    }()
+
+    state.opts.Logger.Printf("Tailing from line %d for %s\n", next, client.RemoteAddr().String())
+
+    for {
+        select {
+        case msg := <-stop:
+            return end_tail(w, msg)
+        case <-state.ShuttingDown():
+            return nil
+        default:
+        }
+
+        // A partial last line is not pushed until it is complete
+        grown := store.Grown()
+        lines := store.CompleteLines()
+        if next <= lines {
+            count := lines - next + 1
+            if count > tail_batch {
+                count = tail_batch
+            }
+            if err := write_each_line(w, zones.GetRange(next, count), count, framing); err != nil {
+                return err
+            }
+            if err := w.Flush(); err != nil {
+                return err
+            }
+            next += count
+            continue
+        }
+
+        if store.Retired() {
+            state.opts.Logger.Printf("Tailed snapshot was replaced; ending push mode for %s\n", client.RemoteAddr().String())
+            if _, err := w.WriteString("ERR\r\n"); err != nil {
+                return err
+            }
+            return w.Flush()
+        }
+
+        // Caught up: wait for more lines
+        select {
+        case <-grown:
+        case msg := <-stop:
+            return end_tail(w, msg)
+        case <-state.ShuttingDown():
+            return nil
+        }
+    }
+}
+
+//
+// Function: end_tail
+//
+// Purpose: Ends push mode on a command from the client: QUIT ends it quietly, and any other
+//          command, which can't be served in push mode, gets ERR
+//
+func end_tail(w *bufio.Writer, msg string) error {
+    if cmd, _ := parse_command(msg); cmd == "QUIT" {
+        return nil
+    }
+    if _, err := w.WriteString("ERR\r\n"); err != nil {
+        return err
+    }
+    return w.Flush()
+}
+
+//
+// Function: write_each_line
+//
+// Purpose: Writes a textReply carrying count lines to the client, as an OK response per line
+//
+func write_each_line(w io.Writer, reply *textReply, count uint64, framing string) error {
+    for i := uint64(0); i < count; i++ {
+        hdr, ok := <-reply.chunks
+        if !ok {
+            hdr.err = io.ErrUnexpectedEOF
+        }
+        err := hdr.err
+        if err == nil {
+            err = write_ok(w, framing, hdr.size)
+        }
+        if err == nil {
+            err = write_body(w, reply, hdr.size)
+        }
+        if err != nil {
+            reply.Abandon()
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,127 @@
+package lineserver
+
+import (
+    "bufio"
+    "io"
+    "net"
+    "os"
+    "testing"
+    "time"
+)
+
+//
+// Function: start_tail
+//
+// Purpose: Serves content in follow mode, and returns the server, the source file, and a client
+//          connection that has sent the given requests
+//
+func start_tail(t *testing.T, content string, requests string) (*Server, string, net.Conn, *bufio.Reader) {
+    t.Helper()
+    srv, addr, _ := start_test_server(t, content, Options{FollowInterval: 10 * time.Millisecond})
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+    if _, err := io.WriteString(conn, requests); err != nil {
+        t.Fatal(err)
+    }
+    return srv, srv.state.current.GetSource(), conn, bufio.NewReader(conn)
+}
+
+//
+// Function: expect
+//
+// Purpose: Reads as many bytes as want holds, and checks that they match it
+//
+func expect(t *testing.T, reader *bufio.Reader, want string) {
+    t.Helper()
+    have := make([]byte, len(want))
+    if _, err := io.ReadFull(reader, have); err != nil || string(have) != want {
+        t.Fatalf("read %q (%v), want %q", have, err, want)
+    }
+}
+
+func expect_closed(t *testing.T, reader *bufio.Reader) {
+    t.Helper()
+    if b, err := reader.ReadByte(); err != io.EOF {
+        t.Fatalf("read %q (%v), want EOF", b, err)
+    }
+}
+
+func append_source(t *testing.T, source_file string, text string) {
+    t.Helper()
+    f, err := os.OpenFile(source_file, os.O_APPEND | os.O_WRONLY, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    if _, err := f.WriteString(text); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestTailPush(t *testing.T) {
+    _, source_file, _, reader := start_tail(t, "a\nb\nc\n", "TAIL 2\r\n")
+
+    // Catches up from line 2, then pushes lines as they are appended
+    expect(t, reader, "OK\r\nb\r\nOK\r\nc\r\n")
+    append_source(t, source_file, "d\ne")
+    expect(t, reader, "OK\r\nd\r\n")
+
+    // A partial last line waits until it is complete
+    time.Sleep(50 * time.Millisecond)
+    append_source(t, source_file, "nd\n")
+    expect(t, reader, "OK\r\nend\r\n")
+}
+
+func TestTailFromPastEnd(t *testing.T) {
+    _, source_file, _, reader := start_tail(t, "a\n", "TAIL 2\r\n")
+
+    // Only new lines are pushed
+    append_source(t, source_file, "b\n")
+    expect(t, reader, "OK\r\nb\r\n")
+}
+
+func TestTailRetired(t *testing.T) {
+    srv, _, _, reader := start_tail(t, "a\n", "TAIL 1\r\n")
+    expect(t, reader, "OK\r\na\r\n")
+
+    // Reindexing replaces the snapshot being tailed, which ends the stream
+    if err := reload_snapshot(srv.state, true); err != nil {
+        t.Fatal(err)
+    }
+    expect(t, reader, "ERR\r\n")
+    expect_closed(t, reader)
+}
+
+func TestTailStop(t *testing.T) {
+    cases := []struct {
+        name string
+        cmd  string
+        want string
+    }{
+        {"quit", "QUIT\r\n", ""},
+        {"other command", "GET 1\r\n", "ERR\r\n"},
+    }
+    for _, tc := range cases {
+        t.Run(tc.name, func(t *testing.T) {
+            _, _, conn, reader := start_tail(t, "a\n", "TAIL 1\r\n")
+            expect(t, reader, "OK\r\na\r\n")
+
+            io.WriteString(conn, tc.cmd)
+            expect(t, reader, tc.want)
+            expect_closed(t, reader)
+        })
+    }
+}
+
+func TestTailWithoutFollow(t *testing.T) {
+    _, addr, _ := start_test_server(t, "a\n", Options{})
+
+    // Refused, and the connection stays in command mode
+    if reply := exchange(t, addr, "TAIL 1\r\nGET 1\r\n"); string(reply) != "ERR\r\nOK\r\na\r\n" {
+        t.Errorf("TAIL without follow mode: got %q", reply)
+    }
+}
@@ -0,0 +1,284 @@
+package lineserver
+
+import (
+    "sort"
+    "sync"
+)
+
+const zone_bytes = 64 * 1024 * 1024    // Source bytes covered by one zone, before load is considered
+const clients_per_zone = 8             // Anticipated concurrent clients one zone can keep up with
+const default_client_load = 16         // Anticipated concurrent clients when -c is unlimited
+const max_zones = 64                   // Upper bound, to stay well clear of the OS file handle limit
+
+//
+//  zoneRequest object - a GET request sent from a client handler to a zone owner, which only
+//  locates the line in the source file. The text is read by a streamer GoRoutine of the client
+//  handler, so an owner never waits on a client.
+//
+type zoneRequest struct {
+    line    uint64
+    count   uint64          // Number of consecutive lines for a range request; zero for a single line
+    located chan location   // Receives the owner's answer; buffered, so the owner never blocks
+}
+
+//
+//  location object - a zone owner's answer to a zoneRequest: the offset and length in the source
+//  file of the requested line, or of the first line of a range
+//
+type location struct {
+    offset uint64
+    length uint64
+    err    error
+}
+
+//
+//  lineZone object - a contiguous range of lines, serviced by one or more owner GoRoutines
+//
+type lineZone struct {
+    id       int
+    first    uint64     // First line number in the zone
+    last     uint64     // Last line number in the zone, when the zones were started
+    requests chan zoneRequest
+}
+
+//
+//  zoneSet object and methods - routes client requests to the owner of the zone for each line
+//
+type zoneSet struct {
+    zones          []*lineZone
+    lines_per_zone uint64
+    store          *lineStore   // Shared by all zone owners
+    wg             *sync.WaitGroup
+}
+
+func (z *zoneSet) Count() int {
+    return len(z.zones)
+}
+
+//
+// Method: Get
+//
+// Purpose: Asks the owner of the specified line's zone to locate it, and streams its text back
+//          on the returned textReply.
+//
+func (z *zoneSet) Get(line uint64) *textReply {
+    return z.request(line, 0, new_text_reply())
+}
+
+//
+// Method: GetInline
+//
+// Purpose: As for Get, but if the line is longer than a chunk, only its size is returned, in a
+//          deferred header. The streamer never waits on the client handler to reply.
+//
+func (z *zoneSet) GetInline(line uint64) *textReply {
+    reply := new_text_reply()
+    reply.inline_only = true
+    return z.request(line, 0, reply)
+}
+
+//
+// Method: GetRange
+//
+// Purpose: As for Get, but for count consecutive lines. The first line is located by the owner of
+//          its zone, even if the range extends into other zones.
+//
+func (z *zoneSet) GetRange(first uint64, count uint64) *textReply {
+    return z.request(first, count, new_text_reply())
+}
+
+//
+// Method: GetWindow
+//
+// Purpose: As for GetInline, for a window of lines. The lines are located by the owners of their
+//          zones in ascending order, and a single streamer then reads them from the source file in
+//          that order, so that the file is read sequentially where possible. The replies are
+//          returned in request order. As no reply holds more than a chunk, the streamer never waits
+//          on the client handler, whichever order it reads the replies in.
+//
+func (z *zoneSet) GetWindow(lines []uint64) []*textReply {
+    order := make([]int, len(lines))
+    for i := range order {
+        order[i] = i
+    }
+    sort.Slice(order, func(a, b int) bool { return lines[order[a]] < lines[order[b]] })
+
+    replies := make([]*textReply, len(lines))
+    located := make([]location, len(lines))
+    for _, i := range order {
+        replies[i] = new_text_reply()
+        replies[i].inline_only = true
+        located[i] = z.locate(lines[i], 0)
+    }
+
+    z.wg.Add(1)
+    go window_streamer(z.store, lines, order, located, replies, z.wg)
+    return replies
+}
+
+func (z *zoneSet) request(line uint64, count uint64, reply *textReply) *textReply {
+    loc := z.locate(line, count)
+    if loc.err != nil {
+        reply.chunks <- chunk{err: loc.err}
+        close(reply.chunks)
+        return reply
+    }
+
+    // The text is read on the client handler's behalf; Close waits for the streamer too
+    z.wg.Add(1)
+    go streamer(z.store, line, count, loc, reply, z.wg)
+    return reply
+}
+
+//
+// Method: locate
+//
+// Purpose: Asks the owner of the specified line's zone to locate it, and waits for its answer
+//
+func (z *zoneSet) locate(line uint64, count uint64) location {
+    lines := z.store.GetLines()
+    if line < 1 || line > lines {
+        return location{err: errOutOfRange}
+    }
+
+    // Lines appended in follow mode belong to the last zone
+    i := (line - 1) / z.lines_per_zone
+    if i >= uint64(len(z.zones)) {
+        i = uint64(len(z.zones) - 1)
+    }
+    located := make(chan location, 1)
+    z.zones[i].requests <- zoneRequest{line, count, located}
+    return <-located
+}
+
+//
+// Method: Close
+//
+// Purpose: Stops all zone owners, once no client handler can send them any more requests, and
+//          closes the store once the last streamer has finished with it
+//
+func (z *zoneSet) Close() {
+    for _, zone := range z.zones {
+        close(zone.requests)
+    }
+    z.wg.Wait()
+    z.store.Close()
+}
+
+//
+// Function: compute_zones
+//
+// Purpose: Computes the number of zones, based on the source file size and anticipated client load
+//
+func compute_zones(source_size int64, lines uint64, clients int) int {
+    if clients <= 0 {
+        clients = default_client_load
+    }
+
+    by_size := int(source_size / zone_bytes) + 1
+    by_load := (clients + clients_per_zone - 1) / clients_per_zone
+
+    zones := by_size
+    if by_load > zones {
+        zones = by_load
+    }
+    if zones > max_zones {
+        zones = max_zones
+    }
+    if uint64(zones) > lines {
+        zones = int(lines)
+    }
+    if zones < 1 {
+        zones = 1
+    }
+    return zones
+}
+
+//
+// Function: start_zones
+//
+// Purpose: Partitions the source file into zones and launches the owner GoRoutines for each zone.
+//          All owners and streamers share the store's file handles.
+//
+func start_zones(store *lineStore, num_zones int, owners int) *zoneSet {
+    if num_zones < 1 {
+        num_zones = 1
+    }
+    if owners < 1 {
+        owners = 1
+    }
+
+    lines_per_zone := (store.GetLines() + uint64(num_zones) - 1) / uint64(num_zones)
+    if lines_per_zone < 1 {
+        lines_per_zone = 1
+    }
+
+    zs := &zoneSet{nil, lines_per_zone, store, new(sync.WaitGroup)}
+
+    for i := 0; i < num_zones; i++ {
+        zone := &lineZone{i, uint64(i) * lines_per_zone + 1, uint64(i + 1) * lines_per_zone, make(chan zoneRequest)}
+        if zone.last > store.GetLines() {
+            zone.last = store.GetLines()
+        }
+        zs.zones = append(zs.zones, zone)
+
+        for o := 0; o < owners; o++ {
+            zs.wg.Add(1)
+            go zone_owner(zone, store, zs.wg)
+        }
+    }
+
+    store.logger.Printf("Started %d zones of %d lines, with %d owners per zone\n", num_zones, lines_per_zone, owners)
+    return zs
+}
+
+//
+// GoRoutine: zone_owner
+//
+// Purpose: Serially locates the lines requested from its zone, until the zone is closed
+//
+func zone_owner(zone *lineZone, store *lineStore, wg *sync.WaitGroup) {
+    // zone owner closure
+    defer wg.Done()
+
+    for req := range zone.requests {
+        req.located <- locate_lines(store, req.line, req.count)
+    }
+}
+
+//
+// GoRoutine: streamer
+//
+// Purpose: Reads the text of a located request from the source file, and sends it to the client
+//          handler in chunks. It waits on the client handler, and on it alone.
+//
+func streamer(store *lineStore, line uint64, count uint64, loc location, reply *textReply, wg *sync.WaitGroup) {
+    // streamer closure
+    defer wg.Done()
+
+    if count == 0 {
+        stream_text(store, line, loc, reply)
+    } else {
+        stream_range(store, line, count, loc.offset, reply)
+    }
+}
+
+//
+// GoRoutine: window_streamer
+//
+// Purpose: Reads the located lines of a window from the source file in the given order, and sends
+//          each to its own inline reply
+//
+func window_streamer(store *lineStore, lines []uint64, order []int, located []location, replies []*textReply, wg *sync.WaitGroup) {
+    // streamer closure
+    defer wg.Done()
+
+    for _, i := range order {
+        if located[i].err != nil {
+            replies[i].chunks <- chunk{err: located[i].err}
+            close(replies[i].chunks)
+            continue
+        }
+        stream_text(store, lines[i], located[i], replies[i])
+    }
+}
@@ -0,0 +1,63 @@
+package lineserver
+
+import (
+    "bytes"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestOwnerNotHeldByClient(t *testing.T) {
+    line := strings.Repeat("x", 999)
+    _, addr, _ := start_test_server(t, strings.Repeat(line + "\n", 16000), Options{Zones: 1, Owners: 1})
+
+    // A client that asks for more than the socket buffers hold, and reads none of it
+    stalled, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer stalled.Close()   // Lets its client handler exit, so the server can be shut down
+    stalled.(*net.TCPConn).SetReadBuffer(4096)
+    stalled.Write([]byte("GETRANGE 1 16000\r\n"))
+    time.Sleep(100 * time.Millisecond)
+
+    // The only owner of the only zone is still free to serve others
+    if reply := exchange(t, addr, "GET 5\r\nGET 16000\r\n"); string(reply) != "OK\r\n" + line + "\r\nOK\r\n" + line + "\r\n" {
+        t.Errorf("while another client stalled: got %.20q", reply)
+    }
+}
+
+func TestGetWindow(t *testing.T) {
+    opts := test_options(t, Options{Zones: 2})
+    cfg := open_snapshot(write_source(t, "one\ntwo\n" + long_line + "\nfour\n"), true, opts)
+    if cfg == nil {
+        t.Fatal("open_snapshot failed")
+    }
+    defer cfg.Release()
+
+    // Read in request order, though streamed in ascending order
+    window := []uint64{4, 9, 3, 1, 4}
+    want := []string{"four", "ERR", "deferred", "one", "four"}
+    for i, reply := range cfg.zones.GetWindow(window) {
+        hdr, ok := <-reply.chunks
+        var got string
+        switch {
+        case !ok || hdr.err != nil:
+            got = "ERR"
+            reply.Abandon()
+        case hdr.deferred:
+            got = "deferred"
+            reply.Abandon()
+        default:
+            var text bytes.Buffer
+            if err := write_data(&text, reply, hdr.size); err != nil {
+                t.Fatal(err)
+            }
+            got = text.String()
+        }
+        if got != want[i] {
+            t.Errorf("line %d: got %q, want %q", window[i], got, want[i])
+        }
+    }
+}